@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionArchive records a dictation session for debugging: each burst's
+// audio exactly as sent to the backend, that is after [audio.dsp] and
+// [audio.denoise] (WAV, so `dictate test`, which applies neither, replays
+// what the backend heard), and a session.json sidecar with the VAD decisions, the backend and the
+// text each burst produced. Sessions live in timestamped directories under
+// [archive] dir; old ones are pruned when a new session starts.
+type sessionArchive struct {
+	dir        string
+	sampleRate int
+	chunkMs    int
+
+	mu   sync.Mutex
+	meta archiveMeta
+	pcm  []byte // audio of the burst in progress
+}
+
+type archiveMeta struct {
+	Started    time.Time      `json:"started"`
+	Ended      *time.Time     `json:"ended,omitempty"`
+	StopReason string         `json:"stop_reason,omitempty"`
+	Backend    string         `json:"backend"`
+	SampleRate int            `json:"sample_rate"`
+	ChunkMs    int            `json:"chunk_ms"`
+	VAD        VADConfig      `json:"vad"`
+	Decisions  []vadSpan      `json:"vad_decisions"`
+	Bursts     []archiveBurst `json:"bursts"`
+}
+
+// vadSpan is a run of chunks with the same VAD decision, in session time.
+type vadSpan struct {
+	StartMs int  `json:"start_ms"`
+	EndMs   int  `json:"end_ms"`
+	Speech  bool `json:"speech"`
+}
+
+type archiveBurst struct {
+	File       string    `json:"file"`
+	Started    time.Time `json:"started"`
+	SessionMs  int       `json:"session_ms"` // VAD time when the burst opened
+	DurationMs int       `json:"duration_ms"`
+	Text       string    `json:"text"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// openArchive prunes old sessions and creates the directory for a new one.
+func openArchive(cfg *Config, started time.Time) (*sessionArchive, error) {
+	root := cfg.Archive.Dir
+	if root == "" {
+		root = filepath.Join(stateDir(), "archive")
+	}
+	if err := pruneArchive(root, cfg.Archive.MaxSessions-1, cfg.Archive.MaxAgeDays); err != nil {
+		log.Printf("archive: prune: %v", err)
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("create archive dir: %w", err)
+	}
+	// Sessions started within the same second get a -2, -3, ... suffix.
+	id := started.Format(sessionIDLayout)
+	dir := filepath.Join(root, id)
+	for n := 2; ; n++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("create archive dir: %w", err)
+		}
+		dir = filepath.Join(root, id+"-"+strconv.Itoa(n))
+	}
+	log.Printf("archive: recording session to %s", dir)
+	return &sessionArchive{
+		dir:        dir,
+		sampleRate: cfg.backendSampleRate(),
+		chunkMs:    cfg.Audio.ChunkMs,
+		meta: archiveMeta{
+			Started:    started,
+			Backend:    cfg.Backend.Name,
+			SampleRate: cfg.backendSampleRate(),
+			ChunkMs:    cfg.Audio.ChunkMs,
+			VAD:        cfg.Audio.VAD,
+			Decisions:  []vadSpan{},
+			Bursts:     []archiveBurst{},
+		},
+	}, nil
+}
+
+// decision records one chunk's VAD decision.
+func (a *sessionArchive) decision(speech bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	d := &a.meta.Decisions
+	if n := len(*d); n > 0 && (*d)[n-1].Speech == speech {
+		(*d)[n-1].EndMs += a.chunkMs
+		return
+	}
+	start := 0
+	if n := len(*d); n > 0 {
+		start = (*d)[n-1].EndMs
+	}
+	*d = append(*d, vadSpan{StartMs: start, EndMs: start + a.chunkMs, Speech: speech})
+}
+
+// tap starts recording a burst and returns a channel that mirrors it.
+func (a *sessionArchive) tap(burst <-chan []byte) <-chan []byte {
+	a.mu.Lock()
+	a.pcm = a.pcm[:0]
+	sessionMs := 0
+	if n := len(a.meta.Decisions); n > 0 {
+		sessionMs = a.meta.Decisions[n-1].EndMs
+	}
+	a.meta.Bursts = append(a.meta.Bursts, archiveBurst{
+		File:      fmt.Sprintf("burst-%03d.wav", len(a.meta.Bursts)+1),
+		Started:   time.Now(),
+		SessionMs: sessionMs,
+	})
+	a.mu.Unlock()
+
+	out := make(chan []byte, cap(burst))
+	go func() {
+		defer close(out)
+		for chunk := range burst {
+			a.mu.Lock()
+			a.pcm = append(a.pcm, chunk...)
+			a.mu.Unlock()
+			out <- chunk
+		}
+	}()
+	return out
+}
+
+// burstDone writes the finished burst's audio and updates the sidecar.
+func (a *sessionArchive) burstDone(text string, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b := &a.meta.Bursts[len(a.meta.Bursts)-1]
+	b.Text = text
+	b.DurationMs = len(a.pcm) / 2 * 1000 / a.sampleRate
+	if err != nil {
+		b.Error = err.Error()
+	}
+	if err := os.WriteFile(filepath.Join(a.dir, b.File), pcmToWAV(a.pcm, a.sampleRate), 0600); err != nil {
+		log.Printf("archive: %v", err)
+	}
+	a.save()
+}
+
+// close records how the session ended.
+func (a *sessionArchive) close(reason error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	a.meta.Ended = &now
+	if reason != nil {
+		a.meta.StopReason = reason.Error()
+	}
+	a.save()
+}
+
+func (a *sessionArchive) save() {
+	data, err := json.MarshalIndent(a.meta, "", "  ")
+	if err != nil {
+		log.Printf("archive: %v", err)
+		return
+	}
+	tmp := filepath.Join(a.dir, "session.json.tmp")
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("archive: %v", err)
+		return
+	}
+	os.Rename(tmp, filepath.Join(a.dir, "session.json"))
+}
+
+// pruneArchive removes session directories beyond the newest keep (negative
+// keeps all) and those older than maxAgeDays (0 = no age limit).
+// archiveStarted parses a session directory name: the session ID, with
+// an optional -N suffix.
+func archiveStarted(name string) (time.Time, bool) {
+	id := name
+	if len(name) > len(sessionIDLayout) {
+		id = name[:len(sessionIDLayout)]
+		n, ok := strings.CutPrefix(name[len(sessionIDLayout):], "-")
+		if _, err := strconv.Atoi(n); !ok || err != nil {
+			return time.Time{}, false
+		}
+	}
+	t, err := time.ParseInLocation(sessionIDLayout, id, time.Local)
+	return t, err == nil
+}
+
+func pruneArchive(root string, keep, maxAgeDays int) error {
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sessions []string
+	for _, e := range entries {
+		if _, ok := archiveStarted(e.Name()); e.IsDir() && ok {
+			sessions = append(sessions, e.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sessions))) // newest first
+	cutoff := time.Now().AddDate(0, 0, -maxAgeDays)
+	for i, name := range sessions {
+		started, _ := archiveStarted(name)
+		if (keep >= 0 && i >= keep) || (maxAgeDays > 0 && started.Before(cutoff)) {
+			if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -1,107 +1,396 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// Recorder captures microphone audio as PCM s16le via arecord or pw-record.
-// No CGo needed — we pipe from a subprocess.
+// Recorder captures audio as PCM s16le from a capture driver:
+//
+//	auto       pw-record if installed, else arecord
+//	pw-record  PipeWire
+//	arecord    ALSA
+//	parec      PulseAudio
+//	ffmpeg     any ffmpeg input (device = input URL/name, ffmpeg_format = -f)
+//	command    a shell command template printing raw PCM to stdout
+//	file       raw PCM read from a file or FIFO (device = path)
+//
+// No CGo needed — we pipe from a subprocess. Audio is captured at the
+// device's native rate and channel count unless [audio] sample_rate and
+// channels say otherwise, so the sound server doesn't resample; convertStream
+// adapts it for backends. Where the driver can't report the native format
+// (arecord, ffmpeg, command, file) capture defaults to 48 kHz mono.
+//
+// If the capture process exits while the session is still running (Bluetooth
+// headset gone, PipeWire restarted) it is restarted with backoff, trying the
+// fallback devices in turn. Its stderr goes to the daemon log.
+//
+// device and fallback_devices form an ordered preference list matched against
+// the sources present when capture (re)starts (see resolveDevices), so a
+// headset is used when connected and the laptop mic otherwise.
 type Recorder struct {
-	sampleRate int
-	chunkBytes int // bytes per chunk to read
-	device     string
-	cmd        *exec.Cmd
-	stdout     io.ReadCloser
+	sampleRate  int // 0 until Start if native
+	channels    int // 0 until Start if native
+	chunkMs     int
+	chunkBytes  int      // bytes per chunk to read
+	prefs       []string // device, then fallback_devices, as configured
+	maxRestarts int
+	driver      string
+	command     string // template for the command driver
+	ffmpegFmt   string // ffmpeg -f for the input
+
+	// OnError, if set, is called when the capture process fails and is
+	// about to be restarted (or given up on).
+	OnError func(error)
+
+	mu  sync.Mutex
+	err error // why capture stopped, if not cancelled
 }
 
 func NewRecorder(cfg AudioConfig) *Recorder {
-	// Each sample is 2 bytes (s16le), mono
-	chunkSamples := cfg.SampleRate * cfg.ChunkMs / 1000
 	return &Recorder{
-		sampleRate: cfg.SampleRate,
-		chunkBytes: chunkSamples * 2,
-		device:     cfg.Device,
+		sampleRate:  cfg.SampleRate,
+		channels:    cfg.Channels,
+		chunkMs:     cfg.ChunkMs,
+		prefs:       append([]string{cfg.Device}, cfg.FallbackDevices...),
+		maxRestarts: cfg.MaxRestarts,
+		driver:      captureDriver(cfg.Driver),
+		command:     cfg.Command,
+		ffmpegFmt:   cfg.FFmpegFormat,
 	}
 }
 
-// Start begins recording. Returns a channel of PCM chunks.
-// Closes the channel when ctx is cancelled or recording stops.
-func (r *Recorder) Start(ctx context.Context) (<-chan []byte, error) {
-	args := r.buildArgs()
-	r.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+// captureDriver resolves "auto" (or "") to the driver that will be used.
+func captureDriver(driver string) string {
+	if driver != "" && driver != "auto" {
+		return driver
+	}
+	if _, err := exec.LookPath("pw-record"); err == nil {
+		return "pw-record"
+	}
+	return "arecord"
+}
 
-	var err error
-	r.stdout, err = r.cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("stdout pipe: %w", err)
+// Capture format used when the device's native format is wanted but the
+// driver can't report it. 48 kHz is what PipeWire, PulseAudio and most USB
+// and HDA mics run at.
+const (
+	fallbackCaptureRate     = 48000
+	fallbackCaptureChannels = 1
+)
+
+// resolveFormat fills in the native rate and channel count of device (the
+// first one capture will try) where the config leaves them at 0. The format
+// then stays fixed for the session, across restarts and fallback devices;
+// the sound server converts if a fallback device differs.
+func (r *Recorder) resolveFormat(device string) {
+	if r.sampleRate <= 0 || r.channels <= 0 {
+		rate, channels := fallbackCaptureRate, fallbackCaptureChannels
+		if src, ok := nativeSource(r.driver, device); ok {
+			if src.Rate > 0 {
+				rate = src.Rate
+			}
+			if src.Channels > 0 {
+				channels = src.Channels
+			}
+			log.Printf("recorder: %s native format %d Hz, %d ch", src.Name, src.Rate, src.Channels)
+		}
+		if r.sampleRate <= 0 {
+			r.sampleRate = rate
+		}
+		if r.channels <= 0 {
+			r.channels = channels
+		}
 	}
+	// Each sample is 2 bytes (s16le), interleaved per channel
+	r.chunkBytes = r.sampleRate * r.chunkMs / 1000 * 2 * r.channels
+}
 
-	if err := r.cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start recorder: %w", err)
+// errInputEnded reports that a finite source reached its end: a file, or an
+// ffmpeg or command input that exited cleanly.
+var errInputEnded = errors.New("end of input")
+
+// Start begins recording. Returns a channel of PCM chunks.
+// Closes the channel when ctx is cancelled or capture fails for good (see Err).
+func (r *Recorder) Start(ctx context.Context) (<-chan []byte, error) {
+	// The first start tries every present device once before giving up.
+	var (
+		proc *captureProc
+		err  error
+	)
+	devs := resolveDevices(r.driver, r.prefs)
+	r.resolveFormat(devs[0])
+	for _, dev := range devs {
+		if proc, err = r.startProc(ctx, dev); err == nil {
+			break
+		}
+		log.Printf("recorder: %v", err)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	ch := make(chan []byte, 16)
 	go func() {
 		defer close(ch)
-		defer r.cmd.Wait()
-		buf := make([]byte, r.chunkBytes)
+		backoff := 500 * time.Millisecond
+		failures := 0
 		for {
-			n, err := io.ReadFull(r.stdout, buf)
-			if n > 0 {
-				chunk := make([]byte, n)
-				copy(chunk, buf[:n])
+			started := time.Now()
+			err := r.pump(ctx, proc, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errInputEnded) {
+				log.Printf("recorder: %s: end of input", proc.name)
+				return
+			}
+			// A run that lasted a while was a working device; start the
+			// count over so a flaky headset isn't given up on for good.
+			if time.Since(started) > time.Minute {
+				failures, backoff = 0, 500*time.Millisecond
+			}
+			for {
+				failures++
+				if failures > r.maxRestarts {
+					r.fail(fmt.Errorf("capture failed %d times, giving up: %w", failures, err))
+					return
+				}
+				r.report(err)
 				select {
-				case ch <- chunk:
+				case <-time.After(backoff):
 				case <-ctx.Done():
 					return
 				}
-			}
-			if err != nil {
-				if err != io.EOF && ctx.Err() == nil {
-					log.Printf("recorder read: %v", err)
+				backoff = min(backoff*2, 10*time.Second)
+				// Try the preferred device first, then each fallback,
+				// re-resolving names since devices come and go.
+				devs := resolveDevices(r.driver, r.prefs)
+				if proc, err = r.startProc(ctx, devs[(failures-1)%len(devs)]); err == nil {
+					break
 				}
-				return
 			}
 		}
 	}()
-
-	log.Printf("Recording started (%s, %d Hz, chunk=%d bytes)",
-		args[0], r.sampleRate, r.chunkBytes)
 	return ch, nil
 }
 
-func (r *Recorder) buildArgs() []string {
-	// Prefer pw-record (PipeWire), fall back to arecord (ALSA)
-	if _, err := exec.LookPath("pw-record"); err == nil {
-		args := []string{
-			"pw-record",
-			"--format=s16",
-			fmt.Sprintf("--rate=%d", r.sampleRate),
-			"--channels=1",
-			"-", // stdout
+// captureProc is one run of the capture subprocess (or an open file).
+type captureProc struct {
+	cmd    *exec.Cmd // nil for the file driver
+	stdout io.ReadCloser
+	name   string // driver and device, for messages
+	stderr chan string
+}
+
+func (p *captureProc) wait() error {
+	if p.cmd == nil {
+		return p.stdout.Close()
+	}
+	return p.cmd.Wait()
+}
+
+func (r *Recorder) startProc(ctx context.Context, device string) (*captureProc, error) {
+	name := r.driver
+	if device != "" {
+		name += " " + device
+	}
+	if r.driver == "file" {
+		return r.openFile(ctx, device, name)
+	}
+
+	args, err := r.buildArgs(device)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("stderr pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start recorder (%s): %w", name, err)
+	}
+
+	// Log stderr; the last line is kept to explain an exit.
+	last := make(chan string, 1)
+	go func() {
+		line := ""
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			line = sc.Text()
+			log.Printf("recorder/%s: %s", r.driver, line)
 		}
-		if r.device != "" {
-			args = append([]string{args[0], "--target=" + r.device}, args[1:]...)
+		last <- line
+	}()
+
+	log.Printf("Recording started (%s, %d Hz, %d ch, chunk=%d bytes)",
+		name, r.sampleRate, r.channels, r.chunkBytes)
+	return &captureProc{cmd: cmd, stdout: stdout, name: name, stderr: last}, nil
+}
+
+// openFile opens a raw PCM file or FIFO. A FIFO is opened read-write so the
+// open doesn't block waiting for a writer and the stream survives writers
+// coming and going; a regular file ends the session at EOF.
+func (r *Recorder) openFile(ctx context.Context, path, name string) (*captureProc, error) {
+	if path == "" {
+		return nil, fmt.Errorf("driver \"file\" needs device = path to a file or FIFO")
+	}
+	flag := os.O_RDONLY
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open capture file: %w", err)
+	}
+	// Unblock a pending read when the session ends.
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	log.Printf("Recording started (%s, %d Hz, %d ch, chunk=%d bytes)",
+		name, r.sampleRate, r.channels, r.chunkBytes)
+	return &captureProc{stdout: f, name: name}, nil
+}
+
+// pump copies chunks from proc to ch until the process exits or ctx ends,
+// and returns why the process stopped.
+func (r *Recorder) pump(ctx context.Context, proc *captureProc, ch chan<- []byte) error {
+	buf := make([]byte, r.chunkBytes)
+	for {
+		n, err := io.ReadFull(proc.stdout, buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			select {
+			case ch <- chunk:
+			case <-ctx.Done():
+				proc.wait()
+				return nil
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				proc.wait()
+				return nil
+			}
+			if proc.cmd == nil {
+				proc.wait()
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					return errInputEnded
+				}
+				return fmt.Errorf("%s: %w", proc.name, err)
+			}
+			// Stdout closed: collect the exit status and stderr.
+			msg := <-proc.stderr
+			werr := proc.wait()
+			switch {
+			case werr == nil && (r.driver == "ffmpeg" || r.driver == "command"):
+				// These read files and streams too; exiting 0 means
+				// the input is done, not that capture broke.
+				return errInputEnded
+			case msg != "":
+				return fmt.Errorf("%s exited: %s", proc.name, msg)
+			case werr != nil:
+				return fmt.Errorf("%s exited: %w", proc.name, werr)
+			default:
+				return fmt.Errorf("%s exited unexpectedly", proc.name)
+			}
 		}
-		return args
 	}
+}
 
-	// arecord fallback
-	args := []string{
-		"arecord",
-		"-f", "S16_LE",
-		"-r", fmt.Sprintf("%d", r.sampleRate),
-		"-c", "1",
-		"-t", "raw",
-		"-q", // quiet
-		"-",  // stdout
+func (r *Recorder) report(err error) {
+	log.Printf("recorder: %v; restarting", err)
+	if r.OnError != nil {
+		r.OnError(err)
 	}
-	if r.device != "" {
-		args = append([]string{args[0], "-D", r.device}, args[1:]...)
+}
+
+func (r *Recorder) fail(err error) {
+	log.Printf("recorder: %v", err)
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+	if r.OnError != nil {
+		r.OnError(err)
+	}
+}
+
+// Err returns why the channel from Start closed without the context being
+// cancelled, or nil.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) buildArgs(device string) ([]string, error) {
+	rate, chans := strconv.Itoa(r.sampleRate), strconv.Itoa(r.channels)
+	switch r.driver {
+	case "pw-record":
+		args := []string{"pw-record", "--format=s16", "--rate=" + rate, "--channels=" + chans}
+		if device != "" {
+			args = append(args, "--target="+device)
+		}
+		return append(args, "-"), nil // stdout
+	case "arecord":
+		args := []string{"arecord", "-f", "S16_LE", "-r", rate, "-c", chans, "-t", "raw", "-q"}
+		if device != "" {
+			args = append(args, "-D", device)
+		}
+		return append(args, "-"), nil // stdout
+	case "parec":
+		args := []string{"parec", "--format=s16le", "--rate=" + rate, "--channels=" + chans, "--raw"}
+		if device != "" {
+			args = append(args, "--device="+device)
+		}
+		return args, nil
+	case "ffmpeg":
+		if device == "" {
+			return nil, fmt.Errorf("driver \"ffmpeg\" needs device = an ffmpeg input (URL, file or device name)")
+		}
+		args := []string{"ffmpeg", "-hide_banner", "-loglevel", "error", "-nostdin"}
+		if r.ffmpegFmt != "" {
+			args = append(args, "-f", r.ffmpegFmt)
+		}
+		return append(args, "-i", device, "-f", "s16le", "-ac", chans, "-ar", rate, "-"), nil
+	case "command":
+		if r.command == "" {
+			return nil, fmt.Errorf("driver \"command\" needs [audio] command")
+		}
+		// The device comes from config or a device listing; quote it so
+		// spaces or shell characters in a name can't change the command.
+		cmd := strings.NewReplacer("{rate}", rate, "{channels}", chans, "{device}", shellQuote(device)).Replace(r.command)
+		return []string{"sh", "-c", cmd}, nil
+	default:
+		return nil, fmt.Errorf("unknown capture driver: %q", r.driver)
 	}
-	return args
+}
+
+// shellQuote quotes s as a single sh word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Format returns the capture format of the chunks produced by Start. It is
+// only known once Start has been called.
+func (r *Recorder) Format() pcmFormat {
+	return pcmFormat{SampleRate: r.sampleRate, Channels: r.channels}
 }
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pcmFormat describes interleaved PCM s16le audio.
+type pcmFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+func (f pcmFormat) String() string {
+	return fmt.Sprintf("%d Hz, %d ch", f.SampleRate, f.Channels)
+}
+
+// readAudioFile loads an audio file and returns it as PCM s16le mono at
+// sampleRate. WAV, FLAC and Ogg FLAC are decoded natively and converted if
+// their rate or channel count differs. Files without a recognised header
+// are taken to be raw s16le in the raw format (see Config.rawInputFormat).
+func readAudioFile(path string, raw pcmFormat, sampleRate int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pcm, format, kind, err := decodeAudio(data)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "raw" {
+		if err := checkRawInput(path, data); err != nil {
+			return nil, err
+		}
+		format = raw
+	}
+
+	if format.SampleRate != sampleRate || format.Channels != 1 {
+		log.Printf("Converting %s (%s) to %d Hz mono", kind, format, sampleRate)
+		conv := newAudioConverter(format, sampleRate)
+		pcm = append(conv.Convert(pcm), conv.Flush()...)
+	}
+	return pcm, nil
+}
+
+// decodeAudio sniffs the container and decodes it to interleaved s16le.
+// kind is "wav", "flac", "ogg" or "raw" (undecoded input returned as-is).
+func decodeAudio(data []byte) (pcm []byte, format pcmFormat, kind string, err error) {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE":
+		pcm, format, err = decodeWAV(data)
+		return pcm, format, "wav", err
+	case len(data) >= 4 && string(data[:4]) == "fLaC":
+		pcm, format, err = decodeFLAC(data)
+		return pcm, format, "flac", err
+	case len(data) >= 4 && string(data[:4]) == "OggS":
+		pcm, format, err = decodeOgg(data)
+		return pcm, format, "ogg", err
+	}
+	return data, pcmFormat{}, "raw", nil
+}
+
+// checkRawInput rejects headerless input that is clearly not raw PCM, so a
+// compressed file is not silently transcribed as noise.
+func checkRawInput(path string, data []byte) error {
+	switch {
+	case len(data) >= 3 && string(data[:3]) == "ID3",
+		len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0:
+		return fmt.Errorf("MP3 is not supported; convert with: ffmpeg -i %s -ar 16000 -ac 1 out.wav", path)
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return fmt.Errorf("MP4/M4A is not supported; convert with: ffmpeg -i %s -ar 16000 -ac 1 out.wav", path)
+	case len(data) >= 4 && bytes.Equal(data[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return fmt.Errorf("WebM/Matroska is not supported; convert with: ffmpeg -i %s -ar 16000 -ac 1 out.wav", path)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".wav", ".flac", ".ogg", ".oga", ".opus", ".mp3", ".m4a":
+		return fmt.Errorf("extension says %s but the header was not recognised", filepath.Ext(path))
+	}
+	if len(data)%2 != 0 {
+		return fmt.Errorf("odd length (%d bytes), not PCM s16le", len(data))
+	}
+	return nil
+}
+
+// --- WAV ---
+
+func decodeWAV(data []byte) ([]byte, pcmFormat, error) {
+	var (
+		format     pcmFormat
+		audioFmt   uint16
+		bits       int
+		haveFmt    bool
+		sampleData []byte
+	)
+	for off := 12; off+8 <= len(data); {
+		id := string(data[off : off+4])
+		size := int(binary.LittleEndian.Uint32(data[off+4:]))
+		body := data[off+8 : min(off+8+size, len(data))]
+		switch id {
+		case "fmt ":
+			if len(body) < 16 {
+				return nil, format, errors.New("wav: short fmt chunk")
+			}
+			audioFmt = binary.LittleEndian.Uint16(body[0:])
+			format.Channels = int(binary.LittleEndian.Uint16(body[2:]))
+			format.SampleRate = int(binary.LittleEndian.Uint32(body[4:]))
+			bits = int(binary.LittleEndian.Uint16(body[14:]))
+			if audioFmt == 0xFFFE && len(body) >= 26 { // WAVE_FORMAT_EXTENSIBLE
+				audioFmt = binary.LittleEndian.Uint16(body[24:])
+			}
+			haveFmt = true
+		case "data":
+			sampleData = body
+		}
+		off += 8 + size + size&1
+	}
+	if !haveFmt || sampleData == nil {
+		return nil, format, errors.New("wav: missing fmt or data chunk")
+	}
+	if format.Channels < 1 || format.SampleRate < 1 {
+		return nil, format, errors.New("wav: bad fmt chunk")
+	}
+
+	var sample func(b []byte) int16
+	switch {
+	case audioFmt == 1 && bits == 8:
+		sample = func(b []byte) int16 { return int16(b[0]-128) << 8 }
+	case audioFmt == 1 && bits == 16:
+		sample = func(b []byte) int16 { return int16(binary.LittleEndian.Uint16(b)) }
+	case audioFmt == 1 && bits == 24:
+		sample = func(b []byte) int16 { return int16(uint16(b[1]) | uint16(b[2])<<8) }
+	case audioFmt == 1 && bits == 32:
+		sample = func(b []byte) int16 { return int16(binary.LittleEndian.Uint32(b) >> 16) }
+	case audioFmt == 3 && bits == 32:
+		sample = func(b []byte) int16 {
+			return floatToS16(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+		}
+	case audioFmt == 3 && bits == 64:
+		sample = func(b []byte) int16 {
+			return floatToS16(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		}
+	default:
+		return nil, format, fmt.Errorf("wav: unsupported encoding (format %d, %d bits)", audioFmt, bits)
+	}
+
+	width := bits / 8
+	n := len(sampleData) / width
+	pcm := make([]byte, n*2)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint16(pcm[i*2:], uint16(sample(sampleData[i*width:])))
+	}
+	return pcm, format, nil
+}
+
+func floatToS16(v float64) int16 {
+	return clampS16(v * 32768)
+}
+
+func clampS16(v float64) int16 {
+	switch {
+	case v > 32767:
+		return 32767
+	case v < -32768:
+		return -32768
+	}
+	return int16(math.Round(v))
+}
+
+// --- Ogg ---
+
+// decodeOgg supports the Ogg FLAC mapping by stripping the Ogg framing and
+// decoding the resulting native FLAC stream. Opus and Vorbis would each need
+// a full codec and are rejected with a conversion hint.
+func decodeOgg(data []byte) ([]byte, pcmFormat, error) {
+	packets, err := oggPackets(data)
+	if err != nil {
+		return nil, pcmFormat{}, err
+	}
+	if len(packets) == 0 {
+		return nil, pcmFormat{}, errors.New("ogg: no packets")
+	}
+	first := packets[0]
+	switch {
+	case len(first) >= 13 && first[0] == 0x7F && string(first[1:5]) == "FLAC" && string(first[9:13]) == "fLaC":
+		// First packet carries "fLaC" + STREAMINFO; later ones are metadata
+		// blocks followed by audio frames, i.e. a native stream in pieces.
+		var native []byte
+		native = append(native, first[9:]...)
+		for _, p := range packets[1:] {
+			native = append(native, p...)
+		}
+		return decodeFLAC(native)
+	case len(first) >= 8 && string(first[:8]) == "OpusHead":
+		return nil, pcmFormat{}, errors.New("Ogg Opus is not supported; convert with: ffmpeg -i FILE -ar 16000 -ac 1 out.wav")
+	case len(first) >= 7 && string(first[1:7]) == "vorbis":
+		return nil, pcmFormat{}, errors.New("Ogg Vorbis is not supported; convert with: ffmpeg -i FILE -ar 16000 -ac 1 out.wav")
+	}
+	return nil, pcmFormat{}, errors.New("ogg: unknown codec")
+}
+
+// oggPackets reassembles the packets of the first logical stream.
+func oggPackets(data []byte) ([][]byte, error) {
+	var (
+		packets [][]byte
+		cur     []byte
+		serial  uint32
+		first   = true
+	)
+	for off := 0; off < len(data); {
+		if off+27 > len(data) || string(data[off:off+4]) != "OggS" {
+			return nil, fmt.Errorf("ogg: bad page at offset %d", off)
+		}
+		pageSerial := binary.LittleEndian.Uint32(data[off+14:])
+		nseg := int(data[off+26])
+		if off+27+nseg > len(data) {
+			return nil, errors.New("ogg: truncated page")
+		}
+		segs := data[off+27 : off+27+nseg]
+		body := off + 27 + nseg
+		if first {
+			serial, first = pageSerial, false
+		}
+		for _, l := range segs {
+			if body+int(l) > len(data) {
+				return nil, errors.New("ogg: truncated segment")
+			}
+			if pageSerial == serial {
+				cur = append(cur, data[body:body+int(l)]...)
+				if l < 255 {
+					packets = append(packets, cur)
+					cur = nil
+				}
+			}
+			body += int(l)
+		}
+		off = body
+	}
+	return packets, nil
+}
+
+// --- FLAC decoder ---
+//
+// Supports everything the reference encoder produces: fixed and LPC
+// subframes, partitioned Rice coding with escapes, wasted bits, stereo
+// decorrelation and 4-32 bit samples (reduced to 16 bits on output).
+
+func decodeFLAC(data []byte) ([]byte, pcmFormat, error) {
+	var format pcmFormat
+	if len(data) < 4 || string(data[:4]) != "fLaC" {
+		return nil, format, errors.New("flac: missing fLaC marker")
+	}
+	r := &bitReader{data: data, pos: 4 * 8}
+
+	bps := 0
+	for {
+		last := r.bits(1)
+		typ := r.bits(7)
+		length := int(r.bits(24))
+		if r.err != nil {
+			return nil, format, r.err
+		}
+		if typ == 0 { // STREAMINFO
+			si := &bitReader{data: data, pos: r.pos}
+			si.bits(16 + 16 + 24 + 24)
+			format.SampleRate = int(si.bits(20))
+			format.Channels = int(si.bits(3)) + 1
+			bps = int(si.bits(5)) + 1
+		}
+		r.pos += length * 8
+		if last == 1 {
+			break
+		}
+	}
+	if bps == 0 {
+		return nil, format, errors.New("flac: missing STREAMINFO")
+	}
+
+	var pcm []byte
+	for r.pos/8+2 <= len(data) {
+		frame, err := decodeFLACFrame(r, format, bps)
+		if err != nil {
+			if len(pcm) > 0 && r.pos/8 >= len(data)-16 {
+				break // tolerate trailing junk after the last frame
+			}
+			return nil, format, err
+		}
+		shift := max(bps-16, 0)
+		for i := range frame[0] {
+			for ch := range frame {
+				s := frame[ch][i] >> shift
+				if bps < 16 {
+					s <<= 16 - bps
+				}
+				pcm = binary.LittleEndian.AppendUint16(pcm, uint16(int16(s)))
+			}
+		}
+	}
+	return pcm, format, nil
+}
+
+func decodeFLACFrame(r *bitReader, format pcmFormat, streamBPS int) ([][]int64, error) {
+	if r.bits(15) != 0x7FFC {
+		return nil, fmt.Errorf("flac: lost frame sync at byte %d", r.pos/8)
+	}
+	r.bits(1) // blocking strategy
+	bsCode := r.bits(4)
+	srCode := r.bits(4)
+	chCode := int(r.bits(4))
+	ssCode := r.bits(3)
+	r.bits(1)
+
+	// Frame/sample number, UTF-8 coded; only its length matters here.
+	lead := r.bits(8)
+	for m := uint64(0x40); lead&0x80 != 0 && lead&m != 0; m >>= 1 {
+		r.bits(8)
+	}
+
+	blockSize := 0
+	switch {
+	case bsCode == 1:
+		blockSize = 192
+	case bsCode >= 2 && bsCode <= 5:
+		blockSize = 576 << (bsCode - 2)
+	case bsCode == 6:
+		blockSize = int(r.bits(8)) + 1
+	case bsCode == 7:
+		blockSize = int(r.bits(16)) + 1
+	case bsCode >= 8:
+		blockSize = 256 << (bsCode - 8)
+	default:
+		return nil, errors.New("flac: reserved block size")
+	}
+	switch srCode {
+	case 12:
+		r.bits(8)
+	case 13, 14:
+		r.bits(16)
+	}
+
+	bps := streamBPS
+	if ssCode != 0 {
+		bps = []int{0, 8, 12, 0, 16, 20, 24, 32}[ssCode]
+	}
+	r.bits(8) // CRC-8
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	channels := chCode + 1
+	if chCode >= 8 {
+		channels = 2
+	}
+	if channels != format.Channels {
+		return nil, fmt.Errorf("flac: frame has %d channels, stream %d", channels, format.Channels)
+	}
+
+	out := make([][]int64, channels)
+	for ch := range out {
+		sbps := bps
+		if (chCode == 8 && ch == 1) || (chCode == 9 && ch == 0) || (chCode == 10 && ch == 1) {
+			sbps++ // side channel carries one extra bit
+		}
+		sub, err := decodeFLACSubframe(r, blockSize, sbps)
+		if err != nil {
+			return nil, err
+		}
+		out[ch] = sub
+	}
+
+	switch chCode {
+	case 8: // left/side
+		for i := range out[0] {
+			out[1][i] = out[0][i] - out[1][i]
+		}
+	case 9: // side/right
+		for i := range out[0] {
+			out[0][i] += out[1][i]
+		}
+	case 10: // mid/side
+		for i := range out[0] {
+			mid, side := out[0][i]<<1|out[1][i]&1, out[1][i]
+			out[0][i] = (mid + side) >> 1
+			out[1][i] = (mid - side) >> 1
+		}
+	}
+
+	r.align()
+	r.bits(16) // CRC-16
+	return out, r.err
+}
+
+func decodeFLACSubframe(r *bitReader, n, bps int) ([]int64, error) {
+	r.bits(1)
+	typ := int(r.bits(6))
+	wasted := 0
+	if r.bits(1) == 1 {
+		wasted = int(r.unary()) + 1
+		bps -= wasted
+	}
+
+	s := make([]int64, n)
+	switch {
+	case typ == 0:
+		v := r.signed(bps)
+		for i := range s {
+			s[i] = v
+		}
+	case typ == 1:
+		for i := range s {
+			s[i] = r.signed(bps)
+		}
+	case typ >= 8 && typ <= 12:
+		order := typ - 8
+		for i := 0; i < order; i++ {
+			s[i] = r.signed(bps)
+		}
+		if err := decodeResidual(r, s, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < n; i++ {
+			switch order {
+			case 1:
+				s[i] += s[i-1]
+			case 2:
+				s[i] += 2*s[i-1] - s[i-2]
+			case 3:
+				s[i] += 3*s[i-1] - 3*s[i-2] + s[i-3]
+			case 4:
+				s[i] += 4*s[i-1] - 6*s[i-2] + 4*s[i-3] - s[i-4]
+			}
+		}
+	case typ >= 32:
+		order := typ - 31
+		for i := 0; i < order; i++ {
+			s[i] = r.signed(bps)
+		}
+		precision := int(r.bits(4)) + 1
+		shift := r.signed(5)
+		if shift < 0 {
+			return nil, errors.New("flac: negative LPC shift")
+		}
+		coefs := make([]int64, order)
+		for i := range coefs {
+			coefs[i] = r.signed(precision)
+		}
+		if err := decodeResidual(r, s, order); err != nil {
+			return nil, err
+		}
+		for i := order; i < n; i++ {
+			var sum int64
+			for j, c := range coefs {
+				sum += c * s[i-1-j]
+			}
+			s[i] += sum >> shift
+		}
+	default:
+		return nil, fmt.Errorf("flac: reserved subframe type %d", typ)
+	}
+
+	if wasted > 0 {
+		for i := range s {
+			s[i] <<= wasted
+		}
+	}
+	return s, r.err
+}
+
+// decodeResidual reads the partitioned Rice residual into s[order:].
+func decodeResidual(r *bitReader, s []int64, order int) error {
+	method := r.bits(2)
+	if method > 1 {
+		return errors.New("flac: reserved residual coding method")
+	}
+	paramBits, escape := 4, uint64(15)
+	if method == 1 {
+		paramBits, escape = 5, 31
+	}
+	partOrder := r.bits(4)
+	parts := 1 << partOrder
+	perPart := len(s) >> partOrder
+
+	i := order
+	for p := 0; p < parts; p++ {
+		count := perPart
+		if p == 0 {
+			count -= order
+		}
+		if count < 0 || i+count > len(s) {
+			return errors.New("flac: bad residual partition")
+		}
+		k := r.bits(paramBits)
+		if k == escape {
+			width := int(r.bits(5))
+			for j := 0; j < count; j++ {
+				s[i] = r.signed(width)
+				i++
+			}
+			continue
+		}
+		for j := 0; j < count; j++ {
+			u := r.unary()<<k | r.bits(int(k))
+			s[i] = int64(u>>1) ^ -int64(u&1)
+			i++
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return r.err
+}
+
+// bitReader reads MSB-first bit fields. Errors are sticky: after running
+// off the end every read returns 0 and err is set.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+func (r *bitReader) bits(n int) uint64 {
+	if n == 0 || r.err != nil {
+		return 0
+	}
+	if r.pos+n > len(r.data)*8 {
+		r.err = errors.New("flac: unexpected end of data")
+		return 0
+	}
+	var v uint64
+	for n > 0 {
+		b := r.data[r.pos>>3]
+		avail := 8 - r.pos&7
+		take := min(avail, n)
+		v = v<<uint(take) | uint64(b>>uint(avail-take))&(1<<uint(take)-1)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+func (r *bitReader) signed(n int) int64 {
+	v := r.bits(n)
+	if n > 0 && v&(1<<uint(n-1)) != 0 {
+		return int64(v) - 1<<uint(n)
+	}
+	return int64(v)
+}
+
+func (r *bitReader) unary() uint64 {
+	var q uint64
+	for r.err == nil {
+		if r.pos>>3 >= len(r.data) {
+			r.err = errors.New("flac: unexpected end of data")
+			return 0
+		}
+		// Skip whole zero bytes quickly.
+		if r.pos&7 == 0 && r.data[r.pos>>3] == 0 {
+			q += 8
+			r.pos += 8
+			continue
+		}
+		if r.bits(1) == 1 {
+			return q
+		}
+		q++
+	}
+	return 0
+}
+
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
@@ -8,7 +8,11 @@ import (
 // Backend streams audio to an STT service and returns text fragments.
 type Backend interface {
 	// Transcribe reads PCM chunks from audioCh and sends text fragments to textCh.
-	// It returns when audioCh is closed or ctx is cancelled.
+	// It returns when audioCh is closed or ctx is cancelled. An empty chunk
+	// marks the end of an utterance (see utteranceEnd); backends that can
+	// finalize early should do so, others may ignore it. It returns an error
+	// if any audio it was sent went untranscribed, so callers can retry;
+	// after audioCh closes it waits for the service to finish.
 	Transcribe(ctx context.Context, audioCh <-chan []byte, textCh chan<- string) error
 }
 
@@ -19,30 +23,43 @@ func NewBackend(cfg *Config) (Backend, error) {
 			"wss://api.mistral.ai/v1/audio/transcriptions/realtime?model="+cfg.Backend.MistralRT.Model,
 			cfg.Backend.MistralRT.Model,
 			mustGetMistralAPIKey(cfg),
-			cfg.Audio.SampleRate,
-		), nil
+			cfg.backendSampleRate(),
+			cfg.Backend.MistralRT.AudioFrames,
+			cfg.Backend.MistralRT.Transport,
+		)
 	case "mistral-batch":
+		apiKey := cfg.Backend.MistralBatch.APIKey
+		if apiKey == "" {
+			apiKey = mustGetMistralAPIKey(cfg)
+		}
 		return NewMistralBatchBackend(
-			mustGetMistralAPIKey(cfg),
-			"voxtral-mini-latest",
-			cfg.Audio.SampleRate,
-			5, // 5 second chunks
-		), nil
+			apiKey,
+			cfg.Backend.MistralBatch.Model,
+			cfg.Backend.Language,
+			cfg.backendSampleRate(),
+			cfg.Backend.MistralBatch.ChunkSeconds,
+			cfg.Backend.MistralBatch.UploadFormat,
+			cfg.Backend.MistralBatch.Transport,
+		)
 	case "vllm-realtime":
 		return NewWebSocketBackend(
 			cfg.Backend.VllmRT.URL,
 			cfg.Backend.VllmRT.Model,
 			"", // no API key for local
-			cfg.Audio.SampleRate,
-		), nil
+			cfg.backendSampleRate(),
+			cfg.Backend.VllmRT.AudioFrames,
+			cfg.Backend.VllmRT.Transport,
+		)
 	case "llamacpp":
 		return NewLlamaCppBackend(
 			cfg.Backend.LlamaCpp.URL,
-			cfg.Audio.SampleRate,
+			cfg.Backend.Language,
+			cfg.backendSampleRate(),
 			cfg.Backend.LlamaCpp.ChunkSeconds,
-		), nil
+			cfg.Backend.LlamaCpp.Transport,
+		)
 	case "mock":
-		return NewMockBackend(cfg.Audio.SampleRate), nil
+		return NewMockBackend(cfg.backendSampleRate()), nil
 	default:
 		return nil, fmt.Errorf("unknown backend: %q", cfg.Backend.Name)
 	}
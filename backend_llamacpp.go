@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -16,23 +17,35 @@ import (
 // Not true streaming — accumulates chunkSeconds of audio, then sends.
 type LlamaCppBackend struct {
 	url          string
+	language     string // empty = detect
 	sampleRate   int
 	chunkSeconds int
+	client       *http.Client
+	transport    TransportConfig
+	stats        wireStats
 }
 
-func NewLlamaCppBackend(url string, sampleRate, chunkSeconds int) *LlamaCppBackend {
+func NewLlamaCppBackend(url, language string, sampleRate, chunkSeconds int, transport TransportConfig) (*LlamaCppBackend, error) {
 	if chunkSeconds <= 0 {
 		chunkSeconds = 3
 	}
+	client, err := transport.HTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("llamacpp transport: %w", err)
+	}
 	return &LlamaCppBackend{
 		url:          url,
+		language:     language,
 		sampleRate:   sampleRate,
 		chunkSeconds: chunkSeconds,
-	}
+		client:       client,
+		transport:    transport,
+	}, nil
 }
 
 func (b *LlamaCppBackend) Transcribe(ctx context.Context, audioCh <-chan []byte, textCh chan<- string) error {
 	bytesPerChunkPeriod := b.sampleRate * 2 * b.chunkSeconds // 2 bytes per sample, mono
+	defer func() { log.Printf("llamacpp: %s", &b.stats) }()
 
 	var accum []byte
 
@@ -41,29 +54,39 @@ func (b *LlamaCppBackend) Transcribe(ctx context.Context, audioCh <-chan []byte,
 		case <-ctx.Done():
 			// Flush remaining audio
 			if len(accum) > 0 {
-				b.sendChunk(ctx, accum, textCh)
+				if err := b.sendChunk(ctx, accum, textCh); err != nil && ctx.Err() == nil {
+					log.Printf("%v (flushing on stop)", err)
+				}
 			}
 			return nil
 		case chunk, ok := <-audioCh:
 			if !ok {
 				if len(accum) > 0 {
-					b.sendChunk(ctx, accum, textCh)
+					return b.sendChunk(ctx, accum, textCh)
 				}
 				return nil
 			}
 			accum = append(accum, chunk...)
 			if len(accum) >= bytesPerChunkPeriod {
-				b.sendChunk(ctx, accum, textCh)
+				if err := b.sendChunk(ctx, accum, textCh); err != nil {
+					return err
+				}
 				accum = nil
 			}
 		}
 	}
 }
 
-func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan<- string) {
-	// Build a minimal WAV header around the raw PCM so llama.cpp can decode it
-	wavData := pcmToWAV(pcm, b.sampleRate)
-	audioB64 := base64.StdEncoding.EncodeToString(wavData)
+// sendChunk transcribes one chunk. An error means its text is lost, so
+// Transcribe returns it for the caller to retry or report.
+func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan<- string) error {
+	// Wrap the raw PCM in a container llama.cpp can decode
+	audioB64 := base64.StdEncoding.EncodeToString(pcmToWAV(pcm, b.sampleRate))
+
+	prompt := "Transcribe the audio exactly. Output only the transcription."
+	if b.language != "" {
+		prompt += fmt.Sprintf(" The speech is in language %q.", b.language)
+	}
 
 	reqBody := map[string]any{
 		"messages": []map[string]any{{
@@ -73,12 +96,12 @@ func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan
 					"type": "input_audio",
 					"input_audio": map[string]any{
 						"data":   audioB64,
-						"format": "wav",
+						"format": uploadWAV,
 					},
 				},
 				{
 					"type": "text",
-					"text": "Transcribe the audio exactly. Output only the transcription.",
+					"text": prompt,
 				},
 			},
 		}},
@@ -89,22 +112,21 @@ func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan
 	body, _ := json.Marshal(reqBody)
 	req, err := http.NewRequestWithContext(ctx, "POST", b.url, bytes.NewReader(body))
 	if err != nil {
-		log.Printf("llamacpp request build: %v", err)
-		return
+		return fmt.Errorf("llamacpp request build: %w", err)
 	}
+	b.transport.applyHeaders(req.Header)
 	req.Header.Set("Content-Type", "application/json")
+	b.stats.add(len(pcm), len(body))
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := b.client.Do(req)
 	if err != nil {
-		log.Printf("llamacpp request: %v", err)
-		return
+		return fmt.Errorf("llamacpp request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		data, _ := io.ReadAll(resp.Body)
-		log.Printf("llamacpp %d: %s", resp.StatusCode, data)
-		return
+		return fmt.Errorf("llamacpp %d: %s", resp.StatusCode, data)
 	}
 
 	var result struct {
@@ -115,8 +137,7 @@ func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan
 		} `json:"choices"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("llamacpp decode: %v", err)
-		return
+		return fmt.Errorf("llamacpp decode: %w", err)
 	}
 
 	if len(result.Choices) > 0 {
@@ -128,6 +149,7 @@ func (b *LlamaCppBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan
 			}
 		}
 	}
+	return nil
 }
 
 // pcmToWAV wraps raw PCM s16le mono data in a minimal WAV header.
@@ -18,95 +18,120 @@ import (
 type MistralBatchBackend struct {
 	apiKey       string
 	model        string
+	language     string // empty = detect
 	sampleRate   int
 	chunkSeconds int
+	upload       *wireFormat
+	client       *http.Client
+	transport    TransportConfig
+	stats        wireStats
 }
 
-func NewMistralBatchBackend(apiKey, model string, sampleRate, chunkSeconds int) *MistralBatchBackend {
+const mistralBatchURL = "https://api.mistral.ai/v1/audio/transcriptions"
+
+func NewMistralBatchBackend(apiKey, model, language string, sampleRate, chunkSeconds int, uploadFormat string, transport TransportConfig) (*MistralBatchBackend, error) {
 	if chunkSeconds <= 0 {
 		chunkSeconds = 5
 	}
 	if model == "" {
 		model = "voxtral-mini-latest"
 	}
+	client, err := transport.HTTPClient()
+	if err != nil {
+		return nil, fmt.Errorf("mistral batch transport: %w", err)
+	}
 	return &MistralBatchBackend{
 		apiKey:       apiKey,
 		model:        model,
+		language:     language,
 		sampleRate:   sampleRate,
 		chunkSeconds: chunkSeconds,
-	}
+		upload:       negotiateFormat("mistral batch", mistralBatchURL, uploadFormat, uploadWAV),
+		client:       client,
+		transport:    transport,
+	}, nil
 }
 
 func (b *MistralBatchBackend) Transcribe(ctx context.Context, audioCh <-chan []byte, textCh chan<- string) error {
 	bytesPerPeriod := b.sampleRate * 2 * b.chunkSeconds
+	defer func() { log.Printf("mistral batch: %s", &b.stats) }()
 	var accum []byte
 
 	for {
 		select {
 		case <-ctx.Done():
 			if len(accum) > 0 {
-				b.sendChunk(ctx, accum, textCh)
+				if err := b.sendChunk(ctx, accum, textCh); err != nil && ctx.Err() == nil {
+					log.Printf("%v (flushing on stop)", err)
+				}
 			}
 			return nil
 		case chunk, ok := <-audioCh:
 			if !ok {
 				if len(accum) > 0 {
-					b.sendChunk(ctx, accum, textCh)
+					return b.sendChunk(ctx, accum, textCh)
 				}
 				return nil
 			}
 			accum = append(accum, chunk...)
 			if len(accum) >= bytesPerPeriod {
-				b.sendChunk(ctx, accum, textCh)
+				if err := b.sendChunk(ctx, accum, textCh); err != nil {
+					return err
+				}
 				accum = nil
 			}
 		}
 	}
 }
 
-func (b *MistralBatchBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan<- string) {
-	wavData := pcmToWAV(pcm, b.sampleRate)
+// sendChunk transcribes one chunk. An error means its text is lost, so
+// Transcribe returns it for the caller to retry or report.
+func (b *MistralBatchBackend) sendChunk(ctx context.Context, pcm []byte, textCh chan<- string) error {
+	format := b.upload.get()
+	audioData := encodeUpload(format, pcm, b.sampleRate)
 
 	var body bytes.Buffer
 	w := multipart.NewWriter(&body)
 	w.WriteField("model", b.model)
+	if b.language != "" {
+		w.WriteField("language", b.language)
+	}
 
-	part, err := w.CreateFormFile("file", "audio.wav")
+	part, err := w.CreateFormFile("file", "audio."+format)
 	if err != nil {
-		log.Printf("mistral batch: create form: %v", err)
-		return
+		return fmt.Errorf("mistral batch: create form: %w", err)
 	}
-	part.Write(wavData)
+	part.Write(audioData)
 	w.Close()
+	b.stats.add(len(pcm), body.Len())
 
-	req, err := http.NewRequestWithContext(ctx, "POST",
-		"https://api.mistral.ai/v1/audio/transcriptions", &body)
+	req, err := http.NewRequestWithContext(ctx, "POST", mistralBatchURL, &body)
 	if err != nil {
-		log.Printf("mistral batch: build request: %v", err)
-		return
+		return fmt.Errorf("mistral batch: build request: %w", err)
 	}
+	b.transport.applyHeaders(req.Header)
 	req.Header.Set("Content-Type", w.FormDataContentType())
 	req.Header.Set("Authorization", "Bearer "+b.apiKey)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := b.client.Do(req)
 	if err != nil {
-		log.Printf("mistral batch: request: %v", err)
-		return
+		return fmt.Errorf("mistral batch: request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
 		data, _ := io.ReadAll(resp.Body)
-		log.Printf("mistral batch %d: %s", resp.StatusCode, data)
-		return
+		if formatRejected(resp.StatusCode, data) && b.upload.reject(format, fmt.Sprintf("HTTP %d", resp.StatusCode)) {
+			return b.sendChunk(ctx, pcm, textCh)
+		}
+		return fmt.Errorf("mistral batch %d: %s", resp.StatusCode, data)
 	}
 
 	var result struct {
 		Text string `json:"text"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("mistral batch: decode: %v", err)
-		return
+		return fmt.Errorf("mistral batch: decode: %w", err)
 	}
 
 	if result.Text != "" {
@@ -115,6 +140,7 @@ func (b *MistralBatchBackend) sendChunk(ctx context.Context, pcm []byte, textCh
 		case <-ctx.Done():
 		}
 	}
+	return nil
 }
 
 func mustGetMistralAPIKey(cfg *Config) string {
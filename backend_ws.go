@@ -4,29 +4,52 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/coder/websocket/wsjson"
 )
 
+// wsDrainTimeout is how long to wait after input_audio.end for the server
+// to finish transcribing and send transcription.done.
+const wsDrainTimeout = 10 * time.Second
+
+// errWSDrain ends a connection whose server never sent transcription.done.
+// All audio was sent by then, so it isn't a transcription error.
+var errWSDrain = errors.New("no transcription.done after the end of audio")
+
 // WebSocketBackend works with both Mistral Realtime API and local vLLM Realtime.
 type WebSocketBackend struct {
 	url        string
 	model      string
 	apiKey     string
 	sampleRate int
+	frames     *wireFormat // "binary" (raw PCM frames) or "json" (base64)
+	client     *http.Client
+	transport  TransportConfig
+	stats      wireStats
 }
 
-func NewWebSocketBackend(url, model, apiKey string, sampleRate int) *WebSocketBackend {
+func NewWebSocketBackend(url, model, apiKey string, sampleRate int, audioFrames string, transport TransportConfig) (*WebSocketBackend, error) {
+	tr, err := transport.httpTransport()
+	if err != nil {
+		return nil, fmt.Errorf("ws transport: %w", err)
+	}
 	return &WebSocketBackend{
 		url:        url,
 		model:      model,
 		apiKey:     apiKey,
 		sampleRate: sampleRate,
-	}
+		frames:     negotiateFormat("ws "+url, url, audioFrames, "json"),
+		// No client Timeout: the connection is long-lived, so the connect
+		// timeout is applied to the handshake context instead.
+		client:    &http.Client{Transport: tr},
+		transport: transport,
+	}, nil
 }
 
 type wsEvent struct {
@@ -35,20 +58,24 @@ type wsEvent struct {
 }
 
 func (b *WebSocketBackend) Transcribe(ctx context.Context, audioCh <-chan []byte, textCh chan<- string) error {
-	opts := &websocket.DialOptions{}
+	opts := &websocket.DialOptions{
+		HTTPClient: b.client,
+		HTTPHeader: http.Header{},
+	}
+	b.transport.applyHeaders(opts.HTTPHeader)
 	if b.apiKey != "" {
-		opts.HTTPHeader = http.Header{
-			"Authorization": {"Bearer " + b.apiKey},
-		}
+		opts.HTTPHeader.Set("Authorization", "Bearer "+b.apiKey)
 	}
 
-	conn, _, err := websocket.Dial(ctx, b.url, opts)
+	dialCtx, dialCancel := context.WithTimeout(ctx, b.transport.connectTimeout())
+	conn, _, err := websocket.Dial(dialCtx, b.url, opts)
+	dialCancel()
 	if err != nil {
 		return fmt.Errorf("ws dial %s: %w", b.url, err)
 	}
 	defer func() {
 		conn.CloseNow()
-		log.Printf("WebSocket disconnected from %s", b.url)
+		log.Printf("WebSocket disconnected from %s (%s)", b.url, &b.stats)
 	}()
 
 	// Increase read limit for large responses
@@ -71,49 +98,55 @@ func (b *WebSocketBackend) Transcribe(ctx context.Context, audioCh <-chan []byte
 			},
 		},
 	})
+	// Binary frames aren't announced in the protocol: they are sent as
+	// configured, and a server that closes with "unsupported data" gets
+	// JSON from the next connection on.
+	binary := b.frames.get() == "binary"
 	if err := conn.Write(ctx, websocket.MessageText, sessionUpdate); err != nil {
 		return fmt.Errorf("ws session update: %w", err)
 	}
 
-	// Send audio in background
-	ctx2, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// Send audio in background. After the last chunk the server still has
+	// to transcribe what it was sent: the reader runs until it says
+	// transcription.done, or until wsDrainTimeout if it never does. The
+	// text received until then stands.
+	ctx2, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
 
 	go func() {
-		defer func() {
-			// Signal end of audio
-			msg, _ := json.Marshal(map[string]string{"type": "input_audio.end"})
-			conn.Write(ctx2, websocket.MessageText, msg)
-			cancel()
-		}()
-		for {
-			select {
-			case <-ctx2.Done():
-				return
-			case chunk, ok := <-audioCh:
-				if !ok {
-					return
-				}
-				b64 := base64.StdEncoding.EncodeToString(chunk)
-				msg, _ := json.Marshal(map[string]string{
-					"type":  "input_audio.append",
-					"audio": b64,
-				})
-				if err := conn.Write(ctx2, websocket.MessageText, msg); err != nil {
-					log.Printf("ws write error: %v", err)
-					return
-				}
-			}
+		if err := b.stream(ctx2, conn, binary, audioCh); err != nil {
+			cancel(err)
+			return
+		}
+		msg, _ := json.Marshal(map[string]string{"type": "input_audio.end"})
+		if err := conn.Write(ctx2, websocket.MessageText, msg); err != nil {
+			cancel(fmt.Errorf("ws write: %w", err))
+			return
+		}
+		select {
+		case <-time.After(wsDrainTimeout):
+			cancel(errWSDrain)
+		case <-ctx2.Done():
 		}
 	}()
 
 	// Read text events
 	for {
-		_, data, err := conn.Read(ctx2)
+		_, data, err := b.read(ctx2, conn)
 		if err != nil {
-			if ctx2.Err() != nil {
+			if ctx.Err() != nil {
 				return nil // normal shutdown
 			}
+			if cause := context.Cause(ctx2); errors.Is(cause, errWSDrain) {
+				log.Printf("ws: %v within %v; keeping the text so far", cause, wsDrainTimeout)
+				return nil
+			} else if cause != nil {
+				return cause // writer failed
+			}
+			if binary && websocket.CloseStatus(err) == websocket.StatusUnsupportedData {
+				b.frames.reject("binary", "close status 1003")
+				return fmt.Errorf("ws read: server does not accept binary audio frames: %w", err)
+			}
 			return fmt.Errorf("ws read: %w", err)
 		}
 		var ev wsEvent
@@ -126,7 +159,7 @@ func (b *WebSocketBackend) Transcribe(ctx context.Context, audioCh <-chan []byte
 			if ev.Text != "" {
 				select {
 				case textCh <- ev.Text:
-				case <-ctx2.Done():
+				case <-ctx.Done():
 					return nil
 				}
 			}
@@ -137,3 +170,50 @@ func (b *WebSocketBackend) Transcribe(ctx context.Context, audioCh <-chan []byte
 		}
 	}
 }
+
+// stream sends audio until audioCh closes (nil), ctx ends or a write
+// fails.
+func (b *WebSocketBackend) stream(ctx context.Context, conn *websocket.Conn, binary bool, audioCh <-chan []byte) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case chunk, ok := <-audioCh:
+			if !ok {
+				return nil
+			}
+			if len(chunk) == 0 {
+				// VAD saw the end of an utterance: have the server
+				// finalize what it has; the session stays open.
+				msg, _ := json.Marshal(map[string]string{"type": "input_audio.flush"})
+				if err := conn.Write(ctx, websocket.MessageText, msg); err != nil {
+					return fmt.Errorf("ws write: %w", err)
+				}
+				continue
+			}
+			typ, msg := websocket.MessageBinary, chunk
+			if !binary {
+				b64 := base64.StdEncoding.EncodeToString(chunk)
+				typ = websocket.MessageText
+				msg, _ = json.Marshal(map[string]string{
+					"type":  "input_audio.append",
+					"audio": b64,
+				})
+			}
+			if err := conn.Write(ctx, typ, msg); err != nil {
+				return fmt.Errorf("ws write: %w", err)
+			}
+			b.stats.add(len(chunk), len(msg))
+		}
+	}
+}
+
+// read reads one message, giving up after the transport idle timeout if set.
+func (b *WebSocketBackend) read(ctx context.Context, conn *websocket.Conn) (websocket.MessageType, []byte, error) {
+	if idle := b.transport.idleTimeout(); idle > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, idle)
+		defer cancel()
+	}
+	return conn.Read(ctx)
+}
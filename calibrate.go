@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// runCalibrate records a few seconds of silence and a few seconds of speech
+// through the normal capture path, prints per-chunk RMS and suggests VAD
+// settings. The threshold is worked out on the levels the configured
+// detector compares with it: per-chunk RMS for energy, per-frame RMS for
+// frame. With -write the suggestions are saved to the config file.
+func runCalibrate(cfg *Config, args []string) {
+	fs := flag.NewFlagSet("calibrate", flag.ExitOnError)
+	secs := fs.Int("seconds", 4, "length of each recording phase")
+	write := fs.Bool("write", false, "write suggested values to the config file")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec := NewRecorder(cfg.Audio)
+	audioCh, err := rec.Start(ctx)
+	if err != nil {
+		log.Fatalf("recorder start: %v", err)
+	}
+	audioCh = convertStream(ctx, audioCh, rec.Format(), cfg.backendSampleRate(), cfg.Audio.ChunkMs)
+	// Measure what VAD will see, i.e. after [audio.dsp].
+	audioCh = dspStream(ctx, audioCh, cfg.Audio.DSP, cfg.backendSampleRate())
+	chunks := max(*secs*1000/cfg.Audio.ChunkMs, 1)
+
+	// The frame detector judges frame_ms frames, so measure those.
+	unitMs, unit := cfg.Audio.ChunkMs, "chunk"
+	frameBytes := 0
+	if cfg.Audio.VAD.Detector == "frame" && cfg.Audio.VAD.FrameMs > 0 {
+		unitMs, unit = cfg.Audio.VAD.FrameMs, "frame"
+		frameBytes = max(cfg.backendSampleRate()*cfg.Audio.VAD.FrameMs/1000, 16) * 2
+	}
+
+	// Let the device settle before measuring.
+	drain(audioCh, max(500/cfg.Audio.ChunkMs, 1))
+
+	fmt.Printf("Stay quiet for %d seconds...\n", *secs)
+	silence := measureRMS(audioCh, chunks, frameBytes)
+	fmt.Printf("\nNow speak normally for %d seconds...\n", *secs)
+	speech := measureRMS(audioCh, chunks, frameBytes)
+	cancel()
+	fmt.Println()
+
+	if len(silence) == 0 || len(speech) == 0 {
+		log.Fatalf("no audio captured")
+	}
+
+	fmt.Printf("RMS per %s (%dms):\n", unit, unitMs)
+	printRMSStats("silence", silence)
+	printRMSStats("speech", speech)
+
+	quiet := percentile(silence, 0.95)
+	voiced := percentile(speech, 0.5)
+	if voiced < quiet*2 {
+		fmt.Println("\nWarning: speech is barely louder than silence. Check mic gain and")
+		fmt.Println("that the right device is selected; consider mode = \"adaptive\".")
+	}
+
+	// Geometric mean sits at the same ratio from both levels, which is what
+	// matters for an energy detector.
+	threshold := math.Round(math.Max(math.Sqrt(quiet*voiced), quiet*1.5))
+
+	// Pre-roll covers the soft onset seen before speech crossed the
+	// threshold, plus one unit; hangover outlasts the longest natural pause
+	// seen while speaking, within reason.
+	onset := longestOnset(speech, quiet, threshold) * unitMs
+	preRoll := max(onset+unitMs, 300)
+	pause := longestRun(speech, threshold) * unitMs
+	hangover := min(max(pause*2, 2*cfg.Audio.ChunkMs), 3000)
+
+	// The adaptive detector sets its own threshold from the noise floor.
+	adaptive := cfg.Audio.VAD.Mode == "adaptive"
+	fmt.Printf("\nSuggested [audio.vad] settings:\n")
+	if adaptive {
+		fmt.Printf("  (threshold not suggested: mode = \"adaptive\" follows the noise floor)\n")
+	} else {
+		fmt.Printf("  threshold = %.0f\n", threshold)
+	}
+	fmt.Printf("  pre_roll_ms = %d   # longest soft onset seen: %dms\n", preRoll, onset)
+	fmt.Printf("  hangover_ms = %d   # longest pause seen: %dms\n", hangover, pause)
+
+	if !*write {
+		fmt.Printf("\nRun with -write to save these to %s\n", configPath())
+		return
+	}
+	var kvs []configKV
+	if !adaptive {
+		kvs = append(kvs, configKV{"threshold", fmt.Sprintf("%.0f", threshold)})
+	}
+	kvs = append(kvs,
+		configKV{"pre_roll_ms", fmt.Sprint(preRoll)},
+		configKV{"hangover_ms", fmt.Sprint(hangover)},
+	)
+	err = setConfigValues(configPath(), "audio.vad", kvs)
+	if err != nil {
+		log.Fatalf("write config: %v", err)
+	}
+	fmt.Printf("\nSaved to %s (restart the daemon to apply)\n", configPath())
+}
+
+func drain(ch <-chan []byte, n int) {
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case <-ch:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// measureRMS reads n chunks and prints each chunk's RMS as it arrives. It
+// returns the RMS of every chunk, or with frameBytes > 0 of every whole
+// frame of that size, as the frame detector sees them.
+func measureRMS(ch <-chan []byte, n, frameBytes int) []float64 {
+	var out []float64
+	for i := 0; i < n; i++ {
+		chunk, ok := <-ch
+		if !ok {
+			break
+		}
+		rms := rmsEnergy(chunk)
+		if frameBytes > 0 {
+			for off := 0; off+frameBytes <= len(chunk); off += frameBytes {
+				out = append(out, rmsEnergy(chunk[off:off+frameBytes]))
+			}
+		} else {
+			out = append(out, rms)
+		}
+		fmt.Fprintf(os.Stdout, "%6.0f", rms)
+		if (i+1)%10 == 0 {
+			fmt.Println()
+		}
+	}
+	return out
+}
+
+func printRMSStats(name string, v []float64) {
+	fmt.Printf("%-8s min %6.0f  median %6.0f  p95 %6.0f  max %6.0f\n",
+		name, percentile(v, 0), percentile(v, 0.5), percentile(v, 0.95), percentile(v, 1))
+}
+
+func percentile(v []float64, p float64) float64 {
+	s := append([]float64(nil), v...)
+	sort.Float64s(s)
+	return s[int(math.Round(p*float64(len(s)-1)))]
+}
+
+// longestOnset returns the longest run of values between quiet and
+// threshold that leads straight into one at or above threshold: how long
+// speech stays soft before the detector would fire.
+func longestOnset(v []float64, quiet, threshold float64) int {
+	best, cur := 0, 0
+	for _, x := range v {
+		switch {
+		case x >= threshold:
+			best = max(best, cur)
+			cur = 0
+		case x > quiet:
+			cur++
+		default:
+			cur = 0
+		}
+	}
+	return best
+}
+
+// longestRun returns the longest run of consecutive values below threshold.
+func longestRun(v []float64, threshold float64) int {
+	best, cur := 0, 0
+	for _, x := range v {
+		if x < threshold {
+			cur++
+			best = max(best, cur)
+		} else {
+			cur = 0
+		}
+	}
+	return best
+}
@@ -4,94 +4,280 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
 	Daemon    DaemonConfig      `toml:"daemon"`
+	Session   SessionConfig     `toml:"session"`
+	Archive   ArchiveConfig     `toml:"archive"`
+	History   HistoryConfig     `toml:"history"`
 	Audio     AudioConfig       `toml:"audio"`
 	Typing    TypingConfig      `toml:"typing"`
+	Text      TextConfig        `toml:"text"`
 	Backend   BackendConfig     `toml:"backend"`
 	Indicator []IndicatorConfig `toml:"indicator"`
+	Profile   []ProfileConfig   `toml:"profile"`
 }
 
 type IndicatorConfig struct {
-	Type      string `toml:"type"`       // "led", "dunstify", "command"
+	Type string `toml:"type"` // "led", "dunstify", "command"
 	// LED options
 	LEDNumber int    `toml:"led_number"` // /proc/acpi/ibm/led number (0=power)
 	Mode      string `toml:"mode"`       // "on" or "blink"
 	// Dunstify options
-	Message   string `toml:"message"`
-	Urgency   string `toml:"urgency"`    // low | normal | critical
+	Message string `toml:"message"`
+	Urgency string `toml:"urgency"` // low | normal | critical
 	// Command options
-	StartCmd  string `toml:"start_cmd"`
-	StopCmd   string `toml:"stop_cmd"`
+	StartCmd string `toml:"start_cmd"`
+	StopCmd  string `toml:"stop_cmd"`
+	ErrorCmd string `toml:"error_cmd"` // run on device errors with $DICTATE_ERROR
 }
 
 type DaemonConfig struct {
 	Socket string `toml:"socket"`
 }
 
+// SessionConfig stops sessions that were left running by accident.
+type SessionConfig struct {
+	IdleMinutes float64 `toml:"idle_minutes"` // stop after this long without speech; 0 = never
+	MaxMinutes  float64 `toml:"max_minutes"`  // stop after this long regardless; 0 = no limit
+	StopOnLock  bool    `toml:"stop_on_lock"` // stop when the screen locks (D-Bus ScreenSaver)
+}
+
+// ArchiveConfig keeps each session's audio and VAD/backend details for
+// debugging (see archive.go).
+type ArchiveConfig struct {
+	Enabled     bool   `toml:"enabled"`
+	Dir         string `toml:"dir"`          // default ~/.local/state/dictate/archive
+	MaxSessions int    `toml:"max_sessions"` // keep at most this many sessions; 0 = no limit
+	MaxAgeDays  int    `toml:"max_age_days"` // delete sessions older than this; 0 = no limit
+}
+
+// HistoryConfig controls the transcript history behind `dictate history`,
+// `last` and `retype` (see history.go).
+type HistoryConfig struct {
+	Enabled bool   `toml:"enabled"`
+	File    string `toml:"file"` // default ~/.local/state/dictate/history.jsonl
+}
+
 type AudioConfig struct {
-	SampleRate int       `toml:"sample_rate"`
-	ChunkMs    int       `toml:"chunk_ms"`
-	Device     string    `toml:"device"`
-	VAD        VADConfig `toml:"vad"`
+	SampleRate int           `toml:"sample_rate"` // capture rate; 0 = device's native (else 48000); converted to the backend's rate
+	Channels   int           `toml:"channels"`    // capture channels; 0 = device's native (else 1); downmixed to mono
+	ChunkMs    int           `toml:"chunk_ms"`
+	Driver     string        `toml:"driver"` // auto | pw-record | arecord | parec | ffmpeg | command | file
+	Device     string        `toml:"device"`
+	VAD        VADConfig     `toml:"vad"`
+	DSP        DSPConfig     `toml:"dsp"`
+	Denoise    DenoiseConfig `toml:"denoise"`
+
+	FallbackDevices []string `toml:"fallback_devices"` // tried in turn when device fails
+	MaxRestarts     int      `toml:"max_restarts"`     // capture restarts before the session ends
+	Command         string   `toml:"command"`          // driver "command": template with {rate} {channels} {device}
+	FFmpegFormat    string   `toml:"ffmpeg_format"`    // driver "ffmpeg": input format (-f), e.g. "pulse"
+}
+
+// DSPConfig is the optional preprocessing chain run before VAD (see dsp.go).
+type DSPConfig struct {
+	Enabled           bool    `toml:"enabled"`
+	HighPassHz        float64 `toml:"high_pass_hz"`        // 0 = no high-pass
+	AGC               bool    `toml:"agc"`                 // automatic gain control
+	AGCTargetRMS      float64 `toml:"agc_target_rms"`      // level AGC aims for
+	AGCMaxGainDB      float64 `toml:"agc_max_gain_db"`     // never amplify more than this
+	LimiterCeiling    float64 `toml:"limiter_ceiling"`     // peak ceiling, fraction of full scale
+	GateThreshold     float64 `toml:"gate_threshold"`      // RMS below which audio is attenuated; 0 = no gate
+	GateAttenuationDB float64 `toml:"gate_attenuation_db"` // how far a closed gate turns audio down
+	GateHoldMs        int     `toml:"gate_hold_ms"`        // stay open this long after the level drops
+}
+
+// DenoiseConfig is the spectral noise suppressor applied to audio sent to
+// the backend (see denoise.go). It learns from chunks VAD calls silence.
+type DenoiseConfig struct {
+	Enabled          bool    `toml:"enabled"`
+	MaxAttenuationDB float64 `toml:"max_attenuation_db"` // never turn a frequency down further
+	AdaptSeconds     float64 `toml:"adapt_seconds"`      // how fast the noise profile follows changes
 }
 
 type VADConfig struct {
-	Enabled     bool    `toml:"enabled"`
-	Threshold   float64 `toml:"threshold"`
-	PreBufferN  int     `toml:"pre_buffer_chunks"`
-	TrailChunks int     `toml:"trail_chunks"`
+	Enabled          bool    `toml:"enabled"`
+	Detector         string  `toml:"detector"`          // "energy" | "frame" | "external"
+	Mode             string  `toml:"mode"`              // "fixed" | "adaptive"
+	Threshold        float64 `toml:"threshold"`         // fixed: RMS that starts speech
+	ReleaseThreshold float64 `toml:"release_threshold"` // fixed: RMS that keeps speech going; 0 = threshold
+	OnsetMarginDB    float64 `toml:"onset_margin_db"`   // adaptive: dB above noise floor to start speech
+	ReleaseMarginDB  float64 `toml:"release_margin_db"` // adaptive: dB above noise floor to keep speech going
+	FloorWindowSec   float64 `toml:"floor_window_seconds"`
+	MinFloor         float64 `toml:"min_floor"` // adaptive: floor never assumed below this RMS
+	FrameMs          int     `toml:"frame_ms"`  // analysis frame within a chunk; 0 = whole-chunk RMS
+	SmoothFrames     int     `toml:"smooth_frames"`
+	MaxZCR           float64 `toml:"max_zcr"`           // 0 = no zero-crossing check
+	MaxFlatness      float64 `toml:"max_flatness"`      // 0 = no flatness check
+	MinBandRatio     float64 `toml:"min_band_ratio"`    // share of energy in 200-4000 Hz
+	PreRollMs        int     `toml:"pre_roll_ms"`       // audio kept from before speech onset
+	HangoverMs       int     `toml:"hangover_ms"`       // silence after speech before the burst closes
+	MinSpeechMs      int     `toml:"min_speech_ms"`     // shorter sounds don't open a burst
+	CommitMs         int     `toml:"commit_ms"`         // pause that ends an utterance (flush); 0 = off
+	PreBufferN       int     `toml:"pre_buffer_chunks"` // deprecated: converted to pre_roll_ms
+	TrailChunks      int     `toml:"trail_chunks"`      // deprecated: converted to hangover_ms
+
+	External ExternalVADConfig `toml:"external"`
+}
+
+// ExternalVADConfig runs a VAD model as a subprocess. See vad_external.go
+// for the protocol.
+type ExternalVADConfig struct {
+	Command   string  `toml:"command"`    // run via sh -c
+	Onset     float64 `toml:"onset"`      // speech probability that starts speech
+	Release   float64 `toml:"release"`    // probability that keeps speech going
+	TimeoutMs int     `toml:"timeout_ms"` // a reply later than this means the detector is stuck
+	StartupMs int     `toml:"startup_ms"` // the same for the first reply, while a model loads
+}
+
+// ProfileConfig overrides settings for sessions started in a matching
+// window (see profile.go). Empty fields keep the global setting.
+type ProfileConfig struct {
+	Name       string `toml:"name"`
+	Class      string `toml:"class"` // regexp on the window class / Wayland app_id
+	Title      string `toml:"title"` // regexp on the window title
+	Method     string `toml:"method"`
+	FocusGuard string `toml:"focus_guard"`
+	Backend    string `toml:"backend"`
+	Language   string `toml:"language"`
+	PasteKey   string `toml:"paste_key"`
+	Case       string `toml:"case"`
+
+	// Replace replaces the [text] rules for this profile.
+	Replace []ReplaceRule `toml:"replace"`
+
+	class, title *regexp.Regexp // compiled by compileProfiles
+}
+
+// TextConfig is post-processing applied to transcribed text before it is
+// typed (see postprocess.go).
+type TextConfig struct {
+	Case    string        `toml:"case"` // keep | sentence | none | lower
+	Replace []ReplaceRule `toml:"replace"`
 }
 
 type TypingConfig struct {
-	Method string `toml:"method"`
+	Method       string   `toml:"method"`
+	FocusGuard   string   `toml:"focus_guard"`   // pause | clipboard | stop | off
+	BlockPrompts bool     `toml:"block_prompts"` // never type into pinentry/polkit/askpass windows
+	DenyClass    []string `toml:"deny_class"`    // regexps on window class / app_id never typed into
+	DenyTitle    []string `toml:"deny_title"`    // regexps on window title never typed into
+	DenyUnknown  bool     `toml:"deny_unknown"`  // hold text on desktops where the focused window can't be seen
+	QueueMax     int      `toml:"queue_max"`     // fragments waiting to be typed before transcription waits
+	Command      string   `toml:"command"`       // method "command": helper reading dotool commands on stdin
+	Persistent   bool     `toml:"persistent"`    // keep dotool/command running for the session
+	PasteKey     string   `toml:"paste_key"`     // method "paste": key pressed after copying, e.g. "ctrl+shift+v"
+
+	deny *windowDenyList // compiled by Config.compile
 }
 
 type BackendConfig struct {
-	Name           string              `toml:"name"`
-	MistralRT      MistralRTConfig     `toml:"mistral-realtime"`
-	VllmRT         VllmRTConfig        `toml:"vllm-realtime"`
-	LlamaCpp       LlamaCppConfig      `toml:"llamacpp"`
+	Name         string             `toml:"name"`
+	Language     string             `toml:"language"` // e.g. "en"; empty = detect (mistral-batch, llamacpp)
+	MistralRT    MistralRTConfig    `toml:"mistral-realtime"`
+	MistralBatch MistralBatchConfig `toml:"mistral-batch"`
+	VllmRT       VllmRTConfig       `toml:"vllm-realtime"`
+	LlamaCpp     LlamaCppConfig     `toml:"llamacpp"`
 }
 
 type MistralRTConfig struct {
-	APIKey string `toml:"api_key"`
-	Model  string `toml:"model"`
+	APIKey      string          `toml:"api_key"`
+	Model       string          `toml:"model"`
+	SampleRate  int             `toml:"sample_rate"`  // PCM rate the backend takes; 0 = 16000
+	AudioFrames string          `toml:"audio_frames"` // "json" (base64) | "binary"
+	Transport   TransportConfig `toml:"transport"`
+}
+
+type MistralBatchConfig struct {
+	APIKey       string          `toml:"api_key"` // empty = mistral-realtime key / MISTRAL_API_KEY
+	Model        string          `toml:"model"`
+	SampleRate   int             `toml:"sample_rate"` // PCM rate the backend takes; 0 = 16000
+	ChunkSeconds int             `toml:"chunk_seconds"`
+	UploadFormat string          `toml:"upload_format"` // "wav" | "flac"
+	Transport    TransportConfig `toml:"transport"`
 }
 
 type VllmRTConfig struct {
-	URL   string `toml:"url"`
-	Model string `toml:"model"`
+	URL         string          `toml:"url"`
+	Model       string          `toml:"model"`
+	SampleRate  int             `toml:"sample_rate"`  // PCM rate the backend takes; 0 = 16000
+	AudioFrames string          `toml:"audio_frames"` // "json" (base64) | "binary"
+	Transport   TransportConfig `toml:"transport"`
 }
 
 type LlamaCppConfig struct {
-	URL          string `toml:"url"`
-	ChunkSeconds int    `toml:"chunk_seconds"`
+	URL          string          `toml:"url"`
+	SampleRate   int             `toml:"sample_rate"` // PCM rate the backend takes; 0 = 16000
+	ChunkSeconds int             `toml:"chunk_seconds"`
+	Transport    TransportConfig `toml:"transport"`
 }
 
 func defaultConfig() *Config {
 	return &Config{
-		Daemon: DaemonConfig{Socket: "/tmp/dictate.sock"},
+		Daemon:  DaemonConfig{Socket: "/tmp/dictate.sock"},
+		Session: SessionConfig{IdleMinutes: 10},
+		Archive: ArchiveConfig{MaxSessions: 50, MaxAgeDays: 14},
+		History: HistoryConfig{Enabled: true},
 		Audio: AudioConfig{
-			SampleRate: 16000,
-			ChunkMs:    480,
+			ChunkMs:     480,
+			MaxRestarts: 10,
+			DSP: DSPConfig{
+				HighPassHz:        80,
+				AGC:               true,
+				AGCTargetRMS:      3000,
+				AGCMaxGainDB:      24,
+				LimiterCeiling:    0.9,
+				GateThreshold:     150,
+				GateAttenuationDB: 30,
+				GateHoldMs:        200,
+			},
+			Denoise: DenoiseConfig{
+				MaxAttenuationDB: 15,
+				AdaptSeconds:     2,
+			},
 			VAD: VADConfig{
-				Enabled:     true,
-				Threshold:   200,
-				PreBufferN:  3,
-				TrailChunks: 21, // ~10s trailing silence before disconnecting
+				Enabled:         true,
+				Detector:        "energy",
+				Mode:            "fixed",
+				Threshold:       200,
+				OnsetMarginDB:   12,
+				ReleaseMarginDB: 6,
+				FloorWindowSec:  10,
+				MinFloor:        20,
+				FrameMs:         20,
+				SmoothFrames:    5,
+				MaxZCR:          0.5,
+				MaxFlatness:     0.5,
+				MinBandRatio:    0.25,
+				PreRollMs:       1440,
+				HangoverMs:      10000, // ~10s trailing silence before disconnecting
+				MinSpeechMs:     200,
+				CommitMs:        700,
+				External: ExternalVADConfig{
+					Onset:     0.5,
+					Release:   0.35,
+					TimeoutMs: 1000,
+					StartupMs: 30000,
+				},
 			},
 		},
-		Typing: TypingConfig{Method: "xdotool"},
+		Typing: TypingConfig{Method: "xdotool", FocusGuard: "pause", BlockPrompts: true, QueueMax: 256, Persistent: true, PasteKey: "ctrl+v"},
+		Text:   TextConfig{Case: "keep"},
 		Backend: BackendConfig{
 			Name: "mistral-realtime",
 			MistralRT: MistralRTConfig{
 				Model: "voxtral-mini-transcribe-realtime-2602",
 			},
+			MistralBatch: MistralBatchConfig{
+				Model:        "voxtral-mini-latest",
+				ChunkSeconds: 5,
+			},
 			VllmRT: VllmRTConfig{
 				URL:   "ws://localhost:8000/v1/realtime",
 				Model: "mistralai/Voxtral-Mini-4B-Realtime-2602",
@@ -104,21 +290,79 @@ func defaultConfig() *Config {
 	}
 }
 
-func mustLoadConfig() *Config {
-	cfg := defaultConfig()
+// backendSampleRate is the rate audio is converted to before it reaches VAD
+// and the backend: the selected backend's own sample_rate, else 16 kHz,
+// which every Voxtral model takes. All backends take PCM s16le mono.
+func (c *Config) backendSampleRate() int {
+	rate := 0
+	switch c.Backend.Name {
+	case "mistral-realtime":
+		rate = c.Backend.MistralRT.SampleRate
+	case "mistral-batch":
+		rate = c.Backend.MistralBatch.SampleRate
+	case "vllm-realtime":
+		rate = c.Backend.VllmRT.SampleRate
+	case "llamacpp":
+		rate = c.Backend.LlamaCpp.SampleRate
+	}
+	if rate > 0 {
+		return rate
+	}
+	return 16000
+}
 
-	// Find config file
+// rawInputFormat is how `dictate test` and `dictate transcribe` read files
+// without a header: raw s16le at [audio] sample_rate and channels, or 16 kHz
+// mono (the historical format) where those are left at native.
+func (c *Config) rawInputFormat() pcmFormat {
+	f := pcmFormat{SampleRate: c.Audio.SampleRate, Channels: c.Audio.Channels}
+	if f.SampleRate <= 0 {
+		f.SampleRate = 16000
+	}
+	if f.Channels <= 0 {
+		f.Channels = 1
+	}
+	return f
+}
+
+// configPath returns the config file location ($DICTATE_CONFIG or the
+// XDG default). The file may not exist.
+func configPath() string {
 	path := os.Getenv("DICTATE_CONFIG")
 	if path == "" {
 		home, _ := os.UserHomeDir()
 		path = filepath.Join(home, ".config", "dictate", "config.toml")
 	}
+	return path
+}
+
+// stateDir is where the daemon keeps data between runs
+// ($XDG_STATE_HOME/dictate, default ~/.local/state/dictate).
+func stateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "dictate")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".local", "state", "dictate")
+}
+
+func mustLoadConfig() *Config {
+	cfg := defaultConfig()
+
+	// Find config file
+	path := configPath()
 
 	if _, err := os.Stat(path); err == nil {
-		if _, err := toml.DecodeFile(path, cfg); err != nil {
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Bad config %s: %v\n", path, err)
 			os.Exit(1)
 		}
+		upgradeVADConfig(cfg, md)
+	}
+	if err := cfg.compile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Bad config %s: %v\n", path, err)
+		os.Exit(1)
 	}
 
 	// Env override for API key
@@ -128,3 +372,120 @@ func mustLoadConfig() *Config {
 
 	return cfg
 }
+
+// upgradeVADConfig converts the old chunk-count VAD settings to their
+// millisecond replacements, unless the new keys are set too.
+func upgradeVADConfig(cfg *Config, md toml.MetaData) {
+	vad := &cfg.Audio.VAD
+	if md.IsDefined("audio", "vad", "pre_buffer_chunks") && !md.IsDefined("audio", "vad", "pre_roll_ms") {
+		vad.PreRollMs = vad.PreBufferN * cfg.Audio.ChunkMs
+	}
+	if md.IsDefined("audio", "vad", "trail_chunks") && !md.IsDefined("audio", "vad", "hangover_ms") {
+		vad.HangoverMs = vad.TrailChunks * cfg.Audio.ChunkMs
+	}
+}
+
+// compile validates and compiles the regexps in the config, so a bad
+// pattern stops the daemon at start-up rather than failing a session.
+func (cfg *Config) compile() error {
+	deny, err := newWindowDenyList(cfg.Typing)
+	if err != nil {
+		return err
+	}
+	cfg.Typing.deny = deny
+	if err := compileText("[text]", cfg.Text.Case, cfg.Text.Replace); err != nil {
+		return err
+	}
+	return compileProfiles(cfg.Profile)
+}
+
+// configKV is one key = value assignment for setConfigValues. Value is
+// written verbatim, so strings must be quoted by the caller.
+type configKV struct {
+	Key, Value string
+}
+
+// setConfigValues rewrites keys in one [section] of a TOML file in place,
+// keeping comments and layout. Missing keys are added at the end of the
+// section; a missing section (or file) is appended.
+func setConfigValues(path, section string, kvs []configKV) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		lines = nil
+	}
+
+	header := "[" + section + "]"
+	start, end := -1, len(lines)
+	for i, l := range lines {
+		t := strings.TrimSpace(l)
+		if t == header {
+			start = i
+			continue
+		}
+		if start >= 0 && strings.HasPrefix(t, "[") {
+			end = i
+			break
+		}
+	}
+	if start < 0 {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, header)
+		start, end = len(lines)-1, len(lines)
+	}
+
+	for _, kv := range kvs {
+		found := false
+		for i := start + 1; i < end; i++ {
+			t := strings.TrimSpace(lines[i])
+			key, _, ok := strings.Cut(t, "=")
+			if !ok || strings.HasPrefix(t, "#") || strings.TrimSpace(key) != kv.Key {
+				continue
+			}
+			// Keep any trailing comment.
+			comment := ""
+			if j := commentStart(lines[i]); j >= 0 {
+				comment = "  " + lines[i][j:]
+			}
+			lines[i] = kv.Key + " = " + kv.Value + comment
+			found = true
+			break
+		}
+		if !found {
+			// Insert after the last non-blank line of the section.
+			at := end
+			for at > start+1 && strings.TrimSpace(lines[at-1]) == "" {
+				at--
+			}
+			lines = append(lines[:at], append([]string{kv.Key + " = " + kv.Value}, lines[at:]...)...)
+			end++
+		}
+	}
+
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// commentStart returns the index of the # that starts a TOML comment on
+// line, or -1. A # inside a quoted string is not a comment.
+func commentStart(line string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && c == '#':
+			return i
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++ // escaped character
+		case c == quote:
+			quote = 0
+		}
+	}
+	return -1
+}
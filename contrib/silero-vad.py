@@ -0,0 +1,46 @@
+"""Silero VAD helper for voxtral-dictate's external detector
+
+Speaks the framed protocol described in vad_external.go: reads
+<uint32 LE length><PCM s16le mono> requests on stdin and answers each with a
+float32 LE speech probability on stdout.
+
+Install:
+    pip install silero-vad
+
+Then in config.toml:
+    [audio.vad]
+    detector = "external"
+
+    [audio.vad.external]
+    command = "python3 /path/to/contrib/silero-vad.py"
+"""
+
+import os
+import struct
+import sys
+
+import torch
+from silero_vad import load_silero_vad
+
+RATE = int(os.environ.get("DICTATE_SAMPLE_RATE", "16000"))
+WINDOW = 512 if RATE == 16000 else 256  # samples per model call (Silero requirement)
+
+model = load_silero_vad()
+stdin, stdout = sys.stdin.buffer, sys.stdout.buffer
+print(f"silero vad ready ({RATE} Hz)", file=sys.stderr, flush=True)
+
+while True:
+    hdr = stdin.read(4)
+    if len(hdr) < 4:
+        break
+    (n,) = struct.unpack("<I", hdr)
+    pcm = stdin.read(n)
+    audio = torch.frombuffer(bytearray(pcm), dtype=torch.int16).float() / 32768.0
+
+    # A chunk holds several model windows; report the most speech-like one.
+    prob = 0.0
+    for i in range(0, len(audio) - WINDOW + 1, WINDOW):
+        prob = max(prob, model(audio[i:i + WINDOW], RATE).item())
+
+    stdout.write(struct.pack("<f", prob))
+    stdout.flush()
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"log"
+	"math"
+)
+
+// convertStream adapts a capture stream to mono PCM s16le at toRate and
+// re-chunks it to chunkMs, so VAD and backends always see fixed-size chunks
+// in the backend's format regardless of what the device delivers. If the
+// capture format already matches, in is returned unchanged.
+func convertStream(ctx context.Context, in <-chan []byte, from pcmFormat, toRate, chunkMs int) <-chan []byte {
+	if from.SampleRate == toRate && from.Channels == 1 {
+		return in
+	}
+	log.Printf("audio: converting capture %s to %d Hz mono", from, toRate)
+
+	chunkBytes := toRate * chunkMs / 1000 * 2
+	out := make(chan []byte, cap(in))
+	go func() {
+		defer close(out)
+		conv := newAudioConverter(from, toRate)
+		var pending []byte
+		send := func(chunk []byte) bool {
+			select {
+			case out <- chunk:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for chunk := range in {
+			pending = append(pending, conv.Convert(chunk)...)
+			for len(pending) >= chunkBytes {
+				c := make([]byte, chunkBytes)
+				copy(c, pending)
+				pending = pending[chunkBytes:]
+				if !send(c) {
+					return
+				}
+			}
+		}
+		if pending = append(pending, conv.Flush()...); len(pending) > 0 {
+			send(pending)
+		}
+	}()
+	return out
+}
+
+// audioConverter turns interleaved PCM s16le in one format into mono s16le
+// at a target sample rate: channels are averaged, then resampled with a
+// windowed-sinc filter. It is streaming — chunks may split frames anywhere —
+// so call Flush once at the end to drain the filter's look-ahead.
+type audioConverter struct {
+	from  pcmFormat
+	carry []byte // partial frame left over from the previous chunk
+	rs    *resampler
+}
+
+func newAudioConverter(from pcmFormat, toRate int) *audioConverter {
+	c := &audioConverter{from: from}
+	if from.SampleRate != toRate {
+		c.rs = newResampler(from.SampleRate, toRate)
+	}
+	return c
+}
+
+// Convert processes the next chunk of input and returns whatever output is
+// ready. The result may be shorter (or longer) than a whole chunk.
+func (c *audioConverter) Convert(pcm []byte) []byte {
+	frameBytes := 2 * c.from.Channels
+	if len(c.carry) > 0 {
+		pcm = append(c.carry, pcm...)
+		c.carry = nil
+	}
+	if rem := len(pcm) % frameBytes; rem != 0 {
+		c.carry = append([]byte(nil), pcm[len(pcm)-rem:]...)
+		pcm = pcm[:len(pcm)-rem]
+	}
+
+	mono := make([]float64, len(pcm)/frameBytes)
+	for i := range mono {
+		var sum float64
+		for ch := 0; ch < c.from.Channels; ch++ {
+			sum += float64(int16(binary.LittleEndian.Uint16(pcm[i*frameBytes+ch*2:])))
+		}
+		mono[i] = sum / float64(c.from.Channels)
+	}
+	if c.rs != nil {
+		mono = c.rs.process(mono)
+	}
+	return floatsToPCM(mono)
+}
+
+// Flush returns the tail held back by the resampler.
+func (c *audioConverter) Flush() []byte {
+	if c.rs == nil {
+		return nil
+	}
+	return floatsToPCM(c.rs.flush())
+}
+
+func floatsToPCM(samples []float64) []byte {
+	out := make([]byte, len(samples)*2)
+	for i, v := range samples {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(clampS16(v)))
+	}
+	return out
+}
+
+// resamplerTaps is the number of filter zero-crossings on each side of the
+// centre. 16 keeps aliasing well below the noise floor of a laptop mic.
+const resamplerTaps = 16
+
+// resampler is a streaming band-limited (windowed-sinc) sample rate
+// converter. Output sample j is taken at input position j*in/out.
+type resampler struct {
+	step   float64   // input samples per output sample
+	cutoff float64   // normalised to the input Nyquist
+	half   int       // filter half-width in input samples
+	hist   []float64 // input not yet fully consumed
+	pos    float64   // position of the next output sample within hist
+	ended  bool
+}
+
+func newResampler(inRate, outRate int) *resampler {
+	cutoff := math.Min(1, float64(outRate)/float64(inRate)) * 0.95
+	half := int(math.Ceil(resamplerTaps / cutoff))
+	return &resampler{
+		step:   float64(inRate) / float64(outRate),
+		cutoff: cutoff,
+		half:   half,
+		// Start with a zero history so the first output lines up with input 0.
+		hist: make([]float64, half),
+		pos:  float64(half),
+	}
+}
+
+func (r *resampler) process(in []float64) []float64 {
+	r.hist = append(r.hist, in...)
+	var out []float64
+	for {
+		centre := int(r.pos)
+		if centre+r.half >= len(r.hist) {
+			break
+		}
+		out = append(out, r.sample(r.pos))
+		r.pos += r.step
+	}
+	// Drop history no longer needed by any future output.
+	if drop := int(r.pos) - r.half; drop > 0 {
+		r.hist = append(r.hist[:0], r.hist[drop:]...)
+		r.pos -= float64(drop)
+	}
+	return out
+}
+
+// flush pads with silence so the remaining input is emitted.
+func (r *resampler) flush() []float64 {
+	if r.ended {
+		return nil
+	}
+	r.ended = true
+	return r.process(make([]float64, r.half+1))
+}
+
+func (r *resampler) sample(t float64) float64 {
+	centre := int(t)
+	var sum, norm float64
+	for i := centre - r.half + 1; i <= centre+r.half; i++ {
+		if i < 0 || i >= len(r.hist) {
+			continue
+		}
+		x := t - float64(i)
+		w := r.kernel(x)
+		sum += r.hist[i] * w
+		norm += w
+	}
+	if norm == 0 {
+		return 0
+	}
+	return sum / norm
+}
+
+// kernel is a Blackman-windowed sinc low-pass at r.cutoff.
+func (r *resampler) kernel(x float64) float64 {
+	if math.Abs(x) >= float64(r.half) {
+		return 0
+	}
+	a := math.Pi * x * r.cutoff
+	s := 1.0
+	if a != 0 {
+		s = math.Sin(a) / a
+	}
+	n := x/float64(r.half)/2 + 0.5 // 0..1 across the window
+	w := 0.42 - 0.5*math.Cos(2*math.Pi*n) + 0.08*math.Cos(4*math.Pi*n)
+	return s * w
+}
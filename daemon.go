@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,9 +19,12 @@ type Daemon struct {
 	cfg        *Config
 	typist     *Typist
 	indicators *IndicatorSet
+	events     *eventHub
+	history    *historyLog
 	mu         sync.Mutex
+	levels     *levelMeter // current or last session's input levels
 	active     bool
-	cancel     context.CancelFunc // cancels current dictation session
+	cancel     context.CancelCauseFunc // cancels current dictation session
 }
 
 func runDaemon(cfg *Config) {
@@ -26,6 +32,8 @@ func runDaemon(cfg *Config) {
 		cfg:        cfg,
 		typist:     NewTypist(cfg.Typing),
 		indicators: NewIndicatorSet(cfg.Indicator),
+		events:     newEventHub(),
+		history:    newHistoryLog(cfg.History),
 	}
 
 	// Clean up stale socket
@@ -43,6 +51,7 @@ func runDaemon(cfg *Config) {
 
 	log.Printf("Daemon listening on %s (backend=%s, typing=%s)",
 		cfg.Daemon.Socket, cfg.Backend.Name, cfg.Typing.Method)
+	d.checkWindowLookup()
 
 	// Handle shutdown signals
 	sigCh := make(chan os.Signal, 1)
@@ -50,7 +59,7 @@ func runDaemon(cfg *Config) {
 	go func() {
 		<-sigCh
 		log.Println("Shutting down...")
-		d.stopDictation()
+		d.stopDictation(errShutdown)
 		d.indicators.Close()
 		d.typist.Close()
 		ln.Close()
@@ -90,7 +99,7 @@ func (d *Daemon) handleConn(conn net.Conn) {
 		d.mu.Unlock()
 
 		if wasActive {
-			d.stopDictation()
+			d.stopDictation(errToggledOff)
 			fmt.Fprintf(conn, "stopped\n")
 			log.Println("Dictation stopped")
 		} else {
@@ -99,20 +108,42 @@ func (d *Daemon) handleConn(conn net.Conn) {
 			log.Println("Dictation started")
 		}
 	case "status":
+		if !ownerOnly(conn, cmd) {
+			return
+		}
 		d.mu.Lock()
 		if d.active {
 			fmt.Fprintf(conn, "active\n")
+			if d.levels != nil {
+				fmt.Fprintf(conn, "levels: %s\n", d.levels)
+			}
 		} else {
 			fmt.Fprintf(conn, "idle\n")
+			if d.levels != nil {
+				fmt.Fprintf(conn, "last session levels: %s\n", d.levels)
+			}
 		}
 		d.mu.Unlock()
+	case "events":
+		if !ownerOnly(conn, cmd) {
+			return
+		}
+		d.events.serveEvents(conn)
+	case "last":
+		d.retype(conn, 1)
 	default:
+		if arg, ok := strings.CutPrefix(cmd, "retype "); ok {
+			if n, err := strconv.Atoi(arg); err == nil {
+				d.retype(conn, n)
+				return
+			}
+		}
 		fmt.Fprintf(conn, "unknown command: %s\n", cmd)
 	}
 }
 
 func (d *Daemon) startDictation() {
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
 
 	d.mu.Lock()
 	d.active = true
@@ -120,59 +151,271 @@ func (d *Daemon) startDictation() {
 	d.mu.Unlock()
 
 	d.indicators.On()
-	go d.runSession(ctx)
+	d.events.publish("started", "")
+	go d.runSession(ctx, cancel)
 }
 
-func (d *Daemon) stopDictation() {
+// stopDictation ends the current session; runSession reports the reason to
+// indicators and the event stream as it winds down.
+func (d *Daemon) stopDictation(reason error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
 	if d.cancel != nil {
-		d.cancel()
+		d.cancel(reason)
 		d.cancel = nil
 	}
 	d.active = false
-	d.indicators.Off()
 }
 
-func (d *Daemon) runSession(ctx context.Context) {
+func (d *Daemon) runSession(ctx context.Context, cancel context.CancelCauseFunc) {
+	started := time.Now()
 	defer func() {
+		cancel(errAudioEnded)
+		reason := context.Cause(ctx)
 		d.mu.Lock()
 		d.active = false
 		d.cancel = nil
 		d.mu.Unlock()
-		d.indicators.Off()
-		log.Println("Session ended")
+		if userStop(reason) {
+			d.indicators.Off("")
+		} else {
+			d.indicators.Off(reason.Error())
+		}
+		d.events.publish("stopped", reason.Error())
+		log.Printf("Session ended: %v", reason)
+		d.mu.Lock()
+		if d.levels != nil {
+			log.Printf("Session levels: %s", d.levels)
+		}
+		d.mu.Unlock()
 	}()
 
-	rec := NewRecorder(d.cfg.Audio)
+	// Text goes to the window that had focus when dictation started, and
+	// that window picks the [[profile]], if any.
+	cfg, typist := d.cfg, d.typist
+	defer d.typist.Release()
+	win, winErr := activeWindow()
+	if winErr == nil {
+		if p := matchProfile(d.cfg.Profile, win); p != nil {
+			log.Printf("Profile %q for %s", p.Name, win)
+			cfg = d.cfg.withProfile(p)
+			if cfg.Typing.Method != d.cfg.Typing.Method || cfg.Typing.PasteKey != d.cfg.Typing.PasteKey {
+				typist = NewTypist(cfg.Typing)
+				defer typist.Close()
+			}
+		}
+	}
+	guard := newFocusGuard(cfg.Typing, typist, win, winErr, func(msg string) {
+		d.indicators.Error(msg)
+		d.events.publish("focus_changed", msg)
+	}, cancel)
+	defer guard.close()
+	typing := newTypeQueue(guard, newTextFormatter(cfg.Text), cfg.Typing.QueueMax, func(err error) {
+		d.indicators.Error(fmt.Sprintf("typing failed: %v", err))
+		d.events.publish("type_error", err.Error())
+	})
+	defer typing.close()
+
+	rec := NewRecorder(cfg.Audio)
+	rec.OnError = func(err error) {
+		d.indicators.Error(err.Error())
+		d.events.publish("device_error", err.Error())
+	}
 	audioCh, err := rec.Start(ctx)
 	if err != nil {
-		log.Printf("recorder start: %v", err)
+		cancel(fmt.Errorf("recorder start: %w", err))
 		return
 	}
 
+	// Measure the raw capture: clipping happens at the device.
+	f := rec.Format()
+	meter := newLevelMeter(f.SampleRate*f.Channels, func(msg string) {
+		d.indicators.Error(msg)
+		d.events.publish("level_warning", msg)
+	})
+	d.mu.Lock()
+	d.levels = meter
+	d.mu.Unlock()
+	audioCh = levelStream(ctx, audioCh, meter)
+
+	// Stop forgotten sessions (idle, too long, screen locked).
+	act := newSessionActivity()
+	go enforceSessionPolicy(ctx, cancel, cfg.Session, act)
+
+	// Capture runs at the device's rate/channels; everything downstream
+	// works in the backend's format.
+	audioCh = convertStream(ctx, audioCh, f, cfg.backendSampleRate(), cfg.Audio.ChunkMs)
+	audioCh = dspStream(ctx, audioCh, cfg.Audio.DSP, cfg.backendSampleRate())
+
 	// VAD splits audio into speech bursts. Each burst is a channel that
 	// opens on speech onset and closes after trailing silence. We connect
 	// a backend per burst, so silence = no connection = no billing.
-	bursts := vadBursts(ctx, audioCh, d.cfg.Audio.VAD)
+	var denoise *noiseSuppressor
+	if cfg.Audio.Denoise.Enabled {
+		if cfg.Audio.VAD.Enabled {
+			denoise = newNoiseSuppressor(cfg.Audio.Denoise, cfg.backendSampleRate())
+		} else {
+			log.Printf("audio: denoise needs [audio.vad] enabled to learn the noise; skipping")
+		}
+	}
+	var (
+		arch  *sessionArchive
+		trace func(bool)
+	)
+	if cfg.Archive.Enabled {
+		if arch, err = openArchive(cfg, started); err != nil {
+			log.Printf("archive: %v", err)
+		} else {
+			trace = arch.decision
+			defer func() {
+				cancel(errAudioEnded) // no-op if already stopped; sets the cause otherwise
+				arch.close(context.Cause(ctx))
+			}()
+		}
+	}
+	bursts := vadBursts(ctx, audioCh, cfg.Audio.VAD, cfg.Audio.ChunkMs, cfg.backendSampleRate(), denoise, trace)
 
 	for burst := range bursts {
 		if ctx.Err() != nil {
 			return
 		}
-		d.handleBurst(ctx, burst)
+		if guard.sensitiveFocus() {
+			for range burst {
+				// Spoken into a password prompt: don't transcribe.
+			}
+			continue
+		}
+		act.burst(true)
+		d.events.publish("burst_start", "")
+		if arch != nil {
+			burst = arch.tap(burst)
+		}
+		err := d.handleBurst(ctx, cfg, burst, typing)
+		text := typing.wait()
+		if arch != nil {
+			arch.burstDone(text, err)
+		}
+		d.record(cfg, started, text, guard.typedInto)
+		guard.typedInto = focusedWindow{}
+		act.burst(false)
+		d.events.publish("burst_end", "")
 	}
+	if err := rec.Err(); err != nil {
+		cancel(err)
+	}
+}
+
+// record adds a burst's text to the history along with the window it was
+// typed into (the guard's, as looked up when it was typed).
+func (d *Daemon) record(cfg *Config, started time.Time, text string, w focusedWindow) {
+	if d.history == nil || text == "" {
+		return
+	}
+	e := historyEntry{
+		Time:    time.Now(),
+		Session: started.Format(sessionIDLayout),
+		Backend: cfg.Backend.Name,
+		Text:    text,
+		Window:  w.String(),
+	}
+	d.history.add(e)
 }
 
-func (d *Daemon) handleBurst(ctx context.Context, audioCh <-chan []byte) {
+// retype types history entry n (1 = most recent) into the focused window
+// again, for text that went to the wrong place.
+func (d *Daemon) retype(conn net.Conn, n int) {
+	if !ownerOnly(conn, "retype") {
+		return
+	}
+	text, err := historyText(d.cfg.History, n)
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	if w, err := activeWindow(); err != nil {
+		if failClosed(d.cfg.Typing, err) {
+			fmt.Fprintf(conn, "error: can't check the focused window for password prompts: %v\n", err)
+			return
+		}
+	} else if why, denied := d.cfg.Typing.deny.match(w); denied {
+		fmt.Fprintf(conn, "error: not typing into %s (%s)\n", w, why)
+		return
+	}
+	err = d.typist.Type(text)
+	d.mu.Lock()
+	if !d.active {
+		d.typist.Release() // no session to keep a helper open for
+	}
+	d.mu.Unlock()
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	log.Printf("Retyped history entry %d (%d chars)", n, len([]rune(text)))
+	fmt.Fprintf(conn, "retyped %d chars\n", len([]rune(text)))
+}
+
+// checkWindowLookup warns at start-up when this desktop can't report the
+// focused window, so password prompts and the deny rules can't be enforced.
+func (d *Daemon) checkWindowLookup() {
+	if _, err := activeWindow(); !errors.Is(err, errWindowUnsupported) || d.cfg.Typing.deny.empty() {
+		return
+	}
+	msg := "can't see the focused window on this desktop: password prompts and deny rules are not enforced (deny_unknown = true holds text instead)"
+	if d.cfg.Typing.DenyUnknown {
+		msg = "can't see the focused window on this desktop: dictated text is held and copied to the clipboard, never typed (deny_unknown)"
+	}
+	log.Printf("WARNING: %s", msg)
+	d.indicators.Error(msg)
+}
+
+// ownerOnly refuses cmd unless the peer runs as the daemon's user. The
+// socket is world-writable so toggle works for anyone, but status, events
+// and the history show window titles and what was said, and retype types
+// into this user's windows.
+func ownerOnly(conn net.Conn, cmd string) bool {
+	if peerIsOwner(conn) {
+		return true
+	}
+	log.Printf("Refused %s from another user", cmd)
+	fmt.Fprintf(conn, "error: %s is only accepted from the daemon's user\n", cmd)
+	return false
+}
+
+// peerIsOwner reports whether the process on the other end of a Unix
+// socket connection runs as the daemon's user (SO_PEERCRED).
+func peerIsOwner(conn net.Conn) bool {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	return cerr == nil && err == nil && int(cred.Uid) == os.Getuid()
+}
+
+// handleBurst transcribes one burst, reconnecting on errors, and queues
+// the text for typing. It returns the last backend error, if any. It
+// gives up after maxAttempts failures, or once the burst has ended and
+// there is no audio left to resend.
+func (d *Daemon) handleBurst(ctx context.Context, cfg *Config, audioCh <-chan []byte, typing *typeQueue) error {
 	backoff := 500 * time.Millisecond
 	maxBackoff := 10 * time.Second
+	maxAttempts := 5
 
 	// Buffer to survive reconnects within a burst
 	bufCh := make(chan []byte, 64)
+	ended := make(chan struct{}) // audioCh is closed; bufCh holds the rest
 	go func() {
 		defer close(bufCh)
+		defer close(ended)
 		for chunk := range audioCh {
 			select {
 			case bufCh <- chunk:
@@ -187,15 +430,15 @@ func (d *Daemon) handleBurst(ctx context.Context, audioCh <-chan []byte) {
 		}
 	}()
 
-	for {
+	for attempt := 1; ; attempt++ {
 		if ctx.Err() != nil {
-			return
+			return nil
 		}
 
-		backend, err := NewBackend(d.cfg)
+		backend, err := NewBackend(cfg)
 		if err != nil {
 			log.Printf("backend init: %v", err)
-			return
+			return err
 		}
 
 		textCh := make(chan string, 32)
@@ -206,46 +449,36 @@ func (d *Daemon) handleBurst(ctx context.Context, audioCh <-chan []byte) {
 			done <- backend.Transcribe(ctx, bufCh, textCh)
 		}()
 
-		midLine := false
-		endLine := func() {
-			if midLine {
-				fmt.Fprintln(os.Stderr)
-				midLine = false
-			}
+		for text := range textCh {
+			typing.push(text)
+			backoff = 500 * time.Millisecond
 		}
 
-		for {
-			select {
-			case text, ok := <-textCh:
-				if !ok {
-					endLine()
-					goto done
-				}
-				d.typist.Type(text)
-				if !midLine {
-					fmt.Fprintf(os.Stderr, "%s transcribed:", time.Now().Format("2006/01/02 15:04:05"))
-					midLine = true
-				}
-				fmt.Fprint(os.Stderr, text)
-				backoff = 500 * time.Millisecond
-			}
-		}
-	done:
-
 		err = <-done
 		if ctx.Err() != nil {
-			return
+			return nil
 		}
 		if err == nil {
-			return // burst ended cleanly (VAD closed the channel)
+			return nil // burst ended cleanly (VAD closed the channel)
 		}
 
-		endLine()
+		select {
+		case <-ended:
+			if len(bufCh) == 0 {
+				log.Printf("transcribe error (no audio left to resend): %v", err)
+				return err
+			}
+		default:
+		}
+		if attempt == maxAttempts {
+			log.Printf("transcribe error (giving up after %d attempts): %v", attempt, err)
+			return err
+		}
 		log.Printf("transcribe error (retrying in %v): %v", backoff, err)
 		select {
 		case <-time.After(backoff):
 		case <-ctx.Done():
-			return
+			return err
 		}
 		backoff = min(backoff*2, maxBackoff)
 	}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"math"
+)
+
+// noiseSuppressor is a streaming Wiener-style spectral noise suppressor.
+// It learns a per-frequency noise profile from chunks VAD classified as
+// non-speech and attenuates stationary noise (fans, HVAC, hum) in everything
+// that is sent to the backend.
+//
+// Audio is processed in 50%-overlapping frames with a square-root Hann
+// window for analysis and synthesis, which reconstructs the input exactly
+// when the gain is 1. Gains use the decision-directed a priori SNR estimate
+// (Ephraim–Malah), which avoids most of the "musical noise" of plain
+// spectral subtraction, and never drop below the max_attenuation_db floor.
+// Output lags input by one hop (half a frame, ~16 ms at 16 kHz); chunk sizes
+// are preserved.
+type noiseSuppressor struct {
+	n, hop int
+	window []float64
+
+	in   []float64 // input samples not yet consumed by a frame
+	ola  []float64 // overlap-add accumulator, len n
+	out  []float64 // finished output samples
+	spec []complex128
+
+	noise    []float64 // noise power estimate per bin
+	learned  int       // noise frames seen
+	adapt    float64   // noise estimate smoothing per frame
+	prevPow  []float64 // previous frame's clean power estimate, per bin
+	minGain  float64
+	learning bool // whether the current chunk is noise
+}
+
+func newNoiseSuppressor(cfg DenoiseConfig, sampleRate int) *noiseSuppressor {
+	n := nextPow2(sampleRate * 32 / 1000)
+	hop := n / 2
+	w := hannWindow(n)
+	for i := range w {
+		w[i] = math.Sqrt(w[i])
+	}
+	log.Printf("audio: noise suppression (%d-sample frames, max %gdB)", n, cfg.MaxAttenuationDB)
+	return &noiseSuppressor{
+		n:       n,
+		hop:     hop,
+		window:  w,
+		ola:     make([]float64, n),
+		out:     make([]float64, hop), // one hop of latency
+		spec:    make([]complex128, n),
+		noise:   make([]float64, n/2+1),
+		prevPow: make([]float64, n/2+1),
+		adapt:   smoothing(max(cfg.AdaptSeconds, 0.1), float64(sampleRate)/float64(hop)),
+		minGain: math.Pow(10, -cfg.MaxAttenuationDB/20),
+	}
+}
+
+// Process denoises one chunk of PCM s16le. noise says whether VAD judged
+// the chunk to be non-speech, in which case it also updates the profile.
+// Until some noise has been seen the audio passes through unchanged (but
+// still delayed, to keep the stream continuous).
+func (s *noiseSuppressor) Process(chunk []byte, noise bool) []byte {
+	s.learning = noise
+	s.in = append(s.in, pcmToFloats(chunk)...)
+	for len(s.in) >= s.n {
+		s.frame(s.in[:s.n])
+		s.in = s.in[s.hop:]
+	}
+	k := min(len(chunk)/2, len(s.out))
+	out := floatsToPCM(s.out[:k])
+	s.out = s.out[k:]
+	return out
+}
+
+func (s *noiseSuppressor) frame(x []float64) {
+	for i := range s.spec {
+		s.spec[i] = complex(x[i]*s.window[i], 0)
+	}
+	fft(s.spec)
+
+	bins := s.n/2 + 1
+	if s.learning {
+		for k := 0; k < bins; k++ {
+			p := power(s.spec[k])
+			if s.learned == 0 {
+				s.noise[k] = p
+			} else {
+				s.noise[k] += (p - s.noise[k]) * s.adapt
+			}
+		}
+		s.learned++
+	}
+
+	if s.learned > 0 {
+		const dd = 0.98 // decision-directed weight
+		for k := 0; k < bins; k++ {
+			p := power(s.spec[k])
+			nk := s.noise[k] + 1e-9
+			post := p / nk                                          // a posteriori SNR
+			prio := dd*s.prevPow[k]/nk + (1-dd)*math.Max(post-1, 0) // a priori SNR
+			g := math.Max(prio/(1+prio), s.minGain)
+			s.prevPow[k] = g * g * p
+			s.spec[k] *= complex(g, 0)
+			if k > 0 && k < s.n/2 {
+				s.spec[s.n-k] *= complex(g, 0) // keep the spectrum Hermitian
+			}
+		}
+	}
+
+	ifft(s.spec)
+	for i := range s.ola {
+		s.ola[i] += real(s.spec[i]) * s.window[i]
+	}
+	s.out = append(s.out, s.ola[:s.hop]...)
+	copy(s.ola, s.ola[s.hop:])
+	clear(s.ola[s.n-s.hop:])
+}
+
+func power(c complex128) float64 {
+	return real(c)*real(c) + imag(c)*imag(c)
+}
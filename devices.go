@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+// captureSource is a microphone (or other input) the recorder can open.
+// Name is what pw-record --target / arecord -D takes. Rate and Channels
+// are its native format, 0 where the listing tool doesn't say.
+type captureSource struct {
+	Name        string
+	Description string
+	Default     bool
+	Rate        int
+	Channels    int
+}
+
+// listCaptureSources lists inputs for a capture driver: PipeWire nodes
+// (pw-dump, else pactl) for pw-record, PulseAudio sources for parec and
+// ALSA PCMs (arecord -L) for arecord. It also returns which tool answered.
+// The ffmpeg, command and file drivers take their device verbatim.
+func listCaptureSources(driver string) ([]captureSource, string, error) {
+	switch driver {
+	case "pw-record":
+		srcs, err := pwDumpSources()
+		if err == nil {
+			return srcs, "pw-dump", nil
+		}
+		log.Printf("devices: pw-dump: %v", err)
+		srcs, err = pactlSources()
+		return srcs, "pactl", err
+	case "parec":
+		srcs, err := pactlSources()
+		return srcs, "pactl", err
+	case "arecord":
+		srcs, err := arecordSources()
+		return srcs, "arecord -L", err
+	default:
+		return nil, "", fmt.Errorf("driver %q has no device list; device is used as given", driver)
+	}
+}
+
+func pwDumpSources() ([]captureSource, error) {
+	out, err := exec.Command("pw-dump").Output()
+	if err != nil {
+		return nil, err
+	}
+	var objs []struct {
+		Type string `json:"type"`
+		Info struct {
+			Props map[string]any `json:"props"`
+		} `json:"info"`
+		Props    map[string]any `json:"props"`
+		Metadata []struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(out, &objs); err != nil {
+		return nil, fmt.Errorf("parse pw-dump: %w", err)
+	}
+
+	var srcs []captureSource
+	def := ""
+	for _, o := range objs {
+		switch o.Type {
+		case "PipeWire:Interface:Node":
+			if o.Info.Props["media.class"] != "Audio/Source" {
+				continue
+			}
+			name, _ := o.Info.Props["node.name"].(string)
+			desc, _ := o.Info.Props["node.description"].(string)
+			rate, _ := o.Info.Props["audio.rate"].(float64)
+			chans, _ := o.Info.Props["audio.channels"].(float64)
+			srcs = append(srcs, captureSource{Name: name, Description: desc, Rate: int(rate), Channels: int(chans)})
+		case "PipeWire:Interface:Metadata":
+			if o.Props["metadata.name"] != "default" {
+				continue
+			}
+			for _, m := range o.Metadata {
+				if m.Key != "default.audio.source" {
+					continue
+				}
+				var v struct {
+					Name string `json:"name"`
+				}
+				if json.Unmarshal(m.Value, &v) == nil {
+					def = v.Name
+				}
+			}
+		}
+	}
+	markDefault(srcs, def)
+	return srcs, nil
+}
+
+func pactlSources() ([]captureSource, error) {
+	out, err := exec.Command("pactl", "-f", "json", "list", "sources").Output()
+	if err != nil {
+		return nil, fmt.Errorf("pactl: %w", err)
+	}
+	var list []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		SampleSpec  string `json:"sample_specification"` // e.g. "s16le 2ch 48000Hz"
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("parse pactl: %w", err)
+	}
+	var srcs []captureSource
+	for _, s := range list {
+		// Monitors capture what is playing, not a microphone.
+		if strings.HasSuffix(s.Name, ".monitor") {
+			continue
+		}
+		src := captureSource{Name: s.Name, Description: s.Description}
+		var sampleFmt string
+		fmt.Sscanf(s.SampleSpec, "%s %dch %dHz", &sampleFmt, &src.Channels, &src.Rate)
+		srcs = append(srcs, src)
+	}
+	def, _ := exec.Command("pactl", "get-default-source").Output()
+	markDefault(srcs, strings.TrimSpace(string(def)))
+	return srcs, nil
+}
+
+// arecordSources parses `arecord -L`: a PCM name at the start of a line,
+// followed by indented description lines.
+func arecordSources() ([]captureSource, error) {
+	out, err := exec.Command("arecord", "-L").Output()
+	if err != nil {
+		return nil, fmt.Errorf("arecord -L: %w", err)
+	}
+	var srcs []captureSource
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			srcs = append(srcs, captureSource{Name: line})
+			continue
+		}
+		if n := len(srcs); n > 0 {
+			s := &srcs[n-1]
+			if s.Description != "" {
+				s.Description += ", "
+			}
+			s.Description += strings.TrimSpace(line)
+		}
+	}
+	markDefault(srcs, "default")
+	return srcs, nil
+}
+
+func markDefault(srcs []captureSource, name string) {
+	for i := range srcs {
+		srcs[i].Default = name != "" && srcs[i].Name == name
+	}
+}
+
+// matchSource finds the source a device setting refers to: an exact name,
+// then an exact description, then a case-insensitive substring of either.
+func matchSource(srcs []captureSource, pattern string) (captureSource, bool) {
+	for _, s := range srcs {
+		if s.Name == pattern {
+			return s, true
+		}
+	}
+	p := strings.ToLower(pattern)
+	for _, s := range srcs {
+		if strings.ToLower(s.Description) == p {
+			return s, true
+		}
+	}
+	for _, s := range srcs {
+		if strings.Contains(strings.ToLower(s.Name), p) || strings.Contains(strings.ToLower(s.Description), p) {
+			return s, true
+		}
+	}
+	return captureSource{}, false
+}
+
+// nativeSource looks up device ("" = the default source) to learn its
+// native format. Only pw-record and parec can report one.
+func nativeSource(driver, device string) (captureSource, bool) {
+	if driver != "pw-record" && driver != "parec" {
+		return captureSource{}, false
+	}
+	srcs, _, err := listCaptureSources(driver)
+	if err != nil {
+		return captureSource{}, false
+	}
+	for _, s := range srcs {
+		if (device == "" && s.Default) || (device != "" && s.Name == device) {
+			return s, true
+		}
+	}
+	return captureSource{}, false
+}
+
+// resolveDevices turns the ordered preference list (device, then
+// fallback_devices) into device names that are present right now, keeping
+// the order. "" means the system default. If sources cannot be listed, or
+// nothing matches, the settings are passed through unchanged so raw ALSA
+// strings like "plughw:1,0" still work.
+func resolveDevices(driver string, prefs []string) []string {
+	if len(prefs) == 0 || (len(prefs) == 1 && prefs[0] == "") {
+		return []string{""}
+	}
+	srcs, _, err := listCaptureSources(driver)
+	if err != nil {
+		return prefs
+	}
+	var out []string
+	for _, p := range prefs {
+		if p == "" {
+			out = append(out, "")
+			continue
+		}
+		if s, ok := matchSource(srcs, p); ok {
+			out = append(out, s.Name)
+		} else {
+			log.Printf("recorder: no capture source matches %q (not connected?)", p)
+		}
+	}
+	if len(out) == 0 {
+		return prefs
+	}
+	return out
+}
+
+// runDevices lists capture sources and shows which one the configured
+// preferences select.
+func runDevices(cfg *Config) {
+	srcs, tool, err := listCaptureSources(captureDriver(cfg.Audio.Driver))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot list capture sources: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Capture sources (%s):\n", tool)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, s := range srcs {
+		mark := " "
+		if s.Default {
+			mark = "*"
+		}
+		format := ""
+		if s.Rate > 0 {
+			format = fmt.Sprintf("%d Hz, %d ch", s.Rate, s.Channels)
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\n", mark, s.Name, format, s.Description)
+	}
+	tw.Flush()
+	fmt.Println("(* = default)")
+
+	prefs := append([]string{cfg.Audio.Device}, cfg.Audio.FallbackDevices...)
+	fmt.Println("\nConfigured preference:")
+	for _, p := range prefs {
+		switch s, ok := matchSource(srcs, p); {
+		case p == "":
+			fmt.Printf("  (default)\n")
+		case ok:
+			fmt.Printf("  %q -> %s\n", p, s.Name)
+		default:
+			fmt.Printf("  %q -> not present\n", p)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+)
+
+// dspStream runs the optional [audio.dsp] chain over mono PCM s16le chunks
+// between conversion and VAD. Chunk sizes are preserved. If the chain is
+// disabled, in is returned unchanged.
+func dspStream(ctx context.Context, in <-chan []byte, cfg DSPConfig, sampleRate int) <-chan []byte {
+	if !cfg.Enabled {
+		return in
+	}
+	log.Printf("audio: dsp chain (high_pass_hz=%g, agc=%v, gate_threshold=%g)", cfg.HighPassHz, cfg.AGC, cfg.GateThreshold)
+	if cfg.AGC && cfg.GateThreshold <= 0 {
+		log.Printf("audio: agc without gate_threshold only turns loud audio down")
+	}
+
+	out := make(chan []byte, cap(in))
+	go func() {
+		defer close(out)
+		chain := newDSPChain(cfg, sampleRate)
+		for chunk := range in {
+			samples := pcmToFloats(chunk)
+			chain.Process(samples)
+			select {
+			case out <- floatsToPCM(samples):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// dspChain is high-pass → noise gate → AGC → limiter, working in place on
+// samples in int16 units. Level decisions (gate, AGC) are made per 10 ms
+// block; gains are ramped per sample so block edges don't click.
+//
+// The gate judges the high-passed input level, before any gain, so its
+// threshold is in the same units `dictate calibrate` reports. AGC only
+// turns the gain up while the gate is open and holds it otherwise, or it
+// would slowly turn silence up to full volume. With no gate nothing tells
+// speech from silence, so AGC may only turn loud audio down.
+type dspChain struct {
+	hp *biquad
+
+	blockLen int
+
+	gateOn    bool
+	gateLevel float64 // open when block RMS >= this
+	gateFloor float64 // linear gain while closed
+	gateHold  int     // blocks to stay open after the level drops
+	holdLeft  int
+	gateGain  float64 // current (ramped) gate gain
+	gateStep  float64 // per-sample ramp toward the target
+
+	agcOn     bool
+	target    float64 // RMS the AGC aims for
+	maxGain   float64
+	gain      float64
+	attack    float64 // per-block smoothing when turning down
+	release   float64 // per-block smoothing when turning up
+	agcSample float64 // per-sample gain, ramped toward gain
+
+	ceiling float64 // limiter peak ceiling
+	limGain float64
+	limRel  float64 // per-sample recovery toward unity
+}
+
+func newDSPChain(cfg DSPConfig, sampleRate int) *dspChain {
+	blockLen := max(sampleRate/100, 1)
+	blocksPerSec := float64(sampleRate) / float64(blockLen)
+	c := &dspChain{
+		blockLen: blockLen,
+
+		gateOn:    cfg.GateThreshold > 0,
+		gateLevel: cfg.GateThreshold,
+		gateFloor: math.Pow(10, -cfg.GateAttenuationDB/20),
+		gateHold:  max(cfg.GateHoldMs/10, 0),
+		gateGain:  1,
+		gateStep:  1 / (0.005 * float64(sampleRate)), // 5 ms fade
+
+		agcOn:     cfg.AGC,
+		target:    cfg.AGCTargetRMS,
+		maxGain:   math.Pow(10, cfg.AGCMaxGainDB/20),
+		gain:      1,
+		attack:    smoothing(0.05, blocksPerSec),
+		release:   smoothing(2, blocksPerSec),
+		agcSample: 1,
+
+		ceiling: cfg.LimiterCeiling * 32767,
+		limGain: 1,
+		limRel:  smoothing(0.1, float64(sampleRate)),
+	}
+	if cfg.HighPassHz > 0 {
+		c.hp = newHighPass(cfg.HighPassHz, float64(sampleRate))
+	}
+	if c.ceiling <= 0 {
+		c.ceiling = 32767
+	}
+	return c
+}
+
+// smoothing returns a one-pole coefficient that moves ~63% of the way to a
+// target in tau seconds at the given update rate.
+func smoothing(tau, rate float64) float64 {
+	return 1 - math.Exp(-1/(tau*rate))
+}
+
+// Process filters samples in place. Calls may be any length; state carries
+// across calls.
+func (c *dspChain) Process(samples []float64) {
+	if c.hp != nil {
+		for i, x := range samples {
+			samples[i] = c.hp.process(x)
+		}
+	}
+	for off := 0; off < len(samples); off += c.blockLen {
+		c.processBlock(samples[off:min(off+c.blockLen, len(samples))])
+	}
+}
+
+func (c *dspChain) processBlock(block []float64) {
+	var sum float64
+	for _, x := range block {
+		sum += x * x
+	}
+	rms := math.Sqrt(sum / float64(len(block)))
+
+	// AGC follows only blocks that are over the threshold themselves, not
+	// the quiet tail the gate holds open for.
+	loud := !c.gateOn || rms >= c.gateLevel
+	open := true
+	if c.gateOn {
+		if loud {
+			c.holdLeft = c.gateHold
+		} else if c.holdLeft > 0 {
+			c.holdLeft--
+		} else {
+			open = false
+		}
+	}
+
+	if c.agcOn && loud && rms > 0 {
+		want := min(c.target/rms, c.maxGain)
+		if !c.gateOn {
+			want = min(want, 1)
+		}
+		k := c.release
+		if want < c.gain {
+			k = c.attack
+		}
+		c.gain += (want - c.gain) * k
+	}
+
+	gateTarget := 1.0
+	if !open {
+		gateTarget = c.gateFloor
+	}
+	for i, x := range block {
+		// Ramp gate and AGC gains per sample.
+		switch {
+		case c.gateGain < gateTarget:
+			c.gateGain = min(c.gateGain+c.gateStep, gateTarget)
+		case c.gateGain > gateTarget:
+			c.gateGain = max(c.gateGain-c.gateStep, gateTarget)
+		}
+		g := 1.0
+		if c.agcOn {
+			c.agcSample += (c.gain - c.agcSample) / float64(len(block))
+			g = c.agcSample
+		}
+		y := x * g * c.gateGain
+
+		// Peak limiter: instant attack, smooth release.
+		if a := math.Abs(y) * c.limGain; a > c.ceiling {
+			c.limGain = c.ceiling / math.Abs(y)
+		}
+		block[i] = y * c.limGain
+		c.limGain += (1 - c.limGain) * c.limRel
+	}
+}
+
+// biquad is a direct form I second-order IIR section.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newHighPass returns a Butterworth (Q = 1/√2) high-pass filter, using the
+// RBJ audio EQ cookbook formulas.
+func newHighPass(cutoff, rate float64) *biquad {
+	w := 2 * math.Pi * cutoff / rate
+	alpha := math.Sin(w) / math.Sqrt2 // sin(w) / 2Q
+	cosw := math.Cos(w)
+	a0 := 1 + alpha
+	return &biquad{
+		b0: (1 + cosw) / 2 / a0,
+		b1: -(1 + cosw) / a0,
+		b2: (1 + cosw) / 2 / a0,
+		a1: -2 * cosw / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const dspTestRate = 16000
+
+// sine returns n samples of a sine wave at freq Hz with the given RMS.
+func sine(freq, rms float64, n int) []float64 {
+	out := make([]float64, n)
+	amp := rms * math.Sqrt2
+	for i := range out {
+		out[i] = amp * math.Sin(2*math.Pi*freq*float64(i)/dspTestRate)
+	}
+	return out
+}
+
+// noise returns n samples of white noise with roughly the given RMS.
+func noise(rms float64, n int, seed int64) []float64 {
+	r := rand.New(rand.NewSource(seed))
+	out := make([]float64, n)
+	for i := range out {
+		out[i] = r.NormFloat64() * rms
+	}
+	return out
+}
+
+func rmsOf(samples []float64) float64 {
+	var sum float64
+	for _, x := range samples {
+		sum += x * x
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+func peakOf(samples []float64) float64 {
+	var p float64
+	for _, x := range samples {
+		p = max(p, math.Abs(x))
+	}
+	return p
+}
+
+// runChain feeds samples through a fresh chain in 480 ms chunks, as
+// dspStream does, and returns the output.
+func runChain(cfg DSPConfig, samples []float64) []float64 {
+	c := newDSPChain(cfg, dspTestRate)
+	out := append([]float64(nil), samples...)
+	chunk := dspTestRate * 480 / 1000
+	for off := 0; off < len(out); off += chunk {
+		c.Process(out[off:min(off+chunk, len(out))])
+	}
+	return out
+}
+
+// tail returns the last d seconds of samples, after the chain has settled.
+func tail(samples []float64, d float64) []float64 {
+	return samples[len(samples)-int(d*dspTestRate):]
+}
+
+func TestDSPDefaultsKeepSilenceBelowVAD(t *testing.T) {
+	cfg := defaultConfig()
+	dsp := cfg.Audio.DSP
+	dsp.Enabled = true
+	out := runChain(dsp, noise(50, 20*dspTestRate, 1))
+	if got, vad := rmsOf(tail(out, 5)), cfg.Audio.VAD.Threshold; got >= vad {
+		t.Errorf("silence at RMS 50 leaves the chain at RMS %.0f, want below the VAD threshold %.0f", got, vad)
+	}
+}
+
+func TestDSPAGCRaisesQuietSpeech(t *testing.T) {
+	dsp := defaultConfig().Audio.DSP
+	dsp.HighPassHz = 0
+	out := runChain(dsp, sine(440, 500, 20*dspTestRate))
+	got := rmsOf(tail(out, 2))
+	if math.Abs(got-dsp.AGCTargetRMS)/dsp.AGCTargetRMS > 0.15 {
+		t.Errorf("AGC output RMS %.0f, want about %.0f", got, dsp.AGCTargetRMS)
+	}
+}
+
+func TestDSPAGCHoldsGainWhileGateClosed(t *testing.T) {
+	dsp := defaultConfig().Audio.DSP
+	dsp.HighPassHz = 0
+	dsp.GateAttenuationDB = 0 // isolate AGC from the gate's own attenuation
+	speech := sine(440, 1000, 10*dspTestRate)
+	silence := noise(50, 20*dspTestRate, 2)
+	out := runChain(dsp, append(speech, silence...))
+
+	gain := rmsOf(tail(out[:len(speech)], 1)) / 1000
+	if got := rmsOf(tail(out, 5)); math.Abs(got/50-gain) > 0.2*gain {
+		t.Errorf("silence left at RMS %.0f (gain %.1f), want the speech gain %.1f held", got, got/50, gain)
+	}
+}
+
+func TestDSPAGCWithoutGateNeverBoosts(t *testing.T) {
+	dsp := defaultConfig().Audio.DSP
+	dsp.HighPassHz = 0
+	dsp.GateThreshold = 0
+	if got := rmsOf(tail(runChain(dsp, noise(50, 20*dspTestRate, 3)), 5)); got > 55 {
+		t.Errorf("silence at RMS 50 turned up to %.0f with no gate", got)
+	}
+	if got := rmsOf(tail(runChain(dsp, sine(440, 8000, 10*dspTestRate)), 2)); got > dsp.AGCTargetRMS*1.15 {
+		t.Errorf("loud input left at RMS %.0f, want turned down to about %.0f", got, dsp.AGCTargetRMS)
+	}
+}
+
+func TestDSPGateAttenuates(t *testing.T) {
+	dsp := DSPConfig{Enabled: true, GateThreshold: 150, GateAttenuationDB: 30, GateHoldMs: 200}
+	quiet := rmsOf(tail(runChain(dsp, sine(440, 100, 4*dspTestRate)), 1))
+	if want := 100 * math.Pow(10, -30.0/20); math.Abs(quiet-want) > want*0.1 {
+		t.Errorf("below the gate: RMS %.1f, want %.1f (30 dB down)", quiet, want)
+	}
+	loud := rmsOf(tail(runChain(dsp, sine(440, 1000, 4*dspTestRate)), 1))
+	if math.Abs(loud-1000) > 10 {
+		t.Errorf("above the gate: RMS %.1f, want 1000 unchanged", loud)
+	}
+}
+
+func TestDSPHighPassRemovesHum(t *testing.T) {
+	dsp := DSPConfig{Enabled: true, HighPassHz: 80}
+	hum := rmsOf(tail(runChain(dsp, sine(50, 1000, 2*dspTestRate)), 1))
+	if db := 20 * math.Log10(hum/1000); db > -6 {
+		t.Errorf("50 Hz hum only %.1f dB down", db)
+	}
+	voice := rmsOf(tail(runChain(dsp, sine(1000, 1000, 2*dspTestRate)), 1))
+	if db := 20 * math.Log10(voice/1000); math.Abs(db) > 0.5 {
+		t.Errorf("1 kHz changed by %.1f dB, want flat", db)
+	}
+}
+
+func TestDSPLimiterCeiling(t *testing.T) {
+	dsp := DSPConfig{Enabled: true, LimiterCeiling: 0.5}
+	out := runChain(dsp, sine(440, 20000, 2*dspTestRate))
+	if p, ceiling := peakOf(out), 0.5*32767; p > ceiling+1 {
+		t.Errorf("peak %.0f over the ceiling %.0f", p, ceiling)
+	}
+}
+
+func TestDSPStreamKeepsChunkSizes(t *testing.T) {
+	dsp := defaultConfig().Audio.DSP
+	dsp.Enabled = true
+	in := make(chan []byte, 3)
+	for _, n := range []int{960, 15360, 2} {
+		in <- floatsToPCM(noise(1000, n/2, int64(n)))
+	}
+	close(in)
+	var sizes []int
+	for chunk := range dspStream(context.Background(), in, dsp, dspTestRate) {
+		sizes = append(sizes, len(chunk))
+	}
+	if len(sizes) != 3 || sizes[0] != 960 || sizes[1] != 15360 || sizes[2] != 2 {
+		t.Errorf("chunk sizes %v, want [960 15360 2]", sizes)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Upload formats for batch backends. WAV is always accepted; FLAC is
+// lossless and typically 40-60% of the size for speech. llama.cpp's
+// input_audio only takes wav and mp3, so only mistral-batch offers FLAC.
+const (
+	uploadWAV  = "wav"
+	uploadFLAC = "flac"
+)
+
+// wireFormat is the format one backend instance uses on the wire with its
+// server: an upload container or a WebSocket framing. It starts as
+// configured and drops to the fallback once the server rejects it. The
+// outcome is shared with later instances of the same backend and server
+// (backends are created per burst), so only the first burst pays for a
+// rejection.
+type wireFormat struct {
+	name     string // backend, for logs
+	fallback string
+
+	mu     sync.Mutex
+	format string
+}
+
+var negotiatedFormats sync.Map // backend, url and configured format -> *wireFormat
+
+// negotiateFormat returns the format state for backend talking to url,
+// preferring configured and falling back to fallback.
+func negotiateFormat(backend, url, configured, fallback string) *wireFormat {
+	if configured == "" {
+		configured = fallback
+	}
+	f, _ := negotiatedFormats.LoadOrStore(backend+" "+url+" "+configured,
+		&wireFormat{name: backend, fallback: fallback, format: configured})
+	return f.(*wireFormat)
+}
+
+func (f *wireFormat) get() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.format
+}
+
+// reject records that the server refused format. It reports whether there
+// is a fallback left to retry with.
+func (f *wireFormat) reject(format, why string) bool {
+	if format == f.fallback {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.format == format {
+		f.format = f.fallback
+		log.Printf("%s: server rejected %s (%s), using %s from now on", f.name, format, why, f.fallback)
+	}
+	return true
+}
+
+// formatRejected reports whether an HTTP error response says the server
+// can't take the upload's format, as opposed to any other bad request.
+func formatRejected(status int, body []byte) bool {
+	switch status {
+	case http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusBadRequest:
+		msg := strings.ToLower(string(body))
+		for _, hint := range []string{"format", "flac", "codec", "decode", "unsupported", "mime"} {
+			if strings.Contains(msg, hint) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// encodeUpload wraps raw PCM s16le mono in the requested container.
+func encodeUpload(format string, pcm []byte, sampleRate int) []byte {
+	switch format {
+	case uploadFLAC:
+		return pcmToFLAC(pcm, sampleRate)
+	default:
+		return pcmToWAV(pcm, sampleRate)
+	}
+}
+
+// wireStats counts raw PCM bytes against bytes actually put on the wire,
+// so the effect of compression or binary framing can be verified in logs.
+type wireStats struct {
+	raw  atomic.Int64
+	sent atomic.Int64
+}
+
+func (s *wireStats) add(raw, sent int) {
+	s.raw.Add(int64(raw))
+	s.sent.Add(int64(sent))
+}
+
+func (s *wireStats) String() string {
+	raw, sent := s.raw.Load(), s.sent.Load()
+	if raw == 0 {
+		return "no audio sent"
+	}
+	return fmt.Sprintf("sent %d bytes for %d bytes PCM (%.0f%%)", sent, raw, 100*float64(sent)/float64(raw))
+}
+
+// --- FLAC encoder ---
+//
+// A minimal pure-Go FLAC encoder for 16-bit mono: fixed blocksize, fixed
+// linear predictors (order 0-4) and a single Rice partition per subframe,
+// with verbatim fallback. That gets most of the gain of reference FLAC on
+// speech without LPC analysis.
+
+const flacBlockSize = 4096
+
+func pcmToFLAC(pcm []byte, sampleRate int) []byte {
+	n := len(pcm) / 2
+	samples := make([]int32, n)
+	for i := range samples {
+		samples[i] = int32(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+	}
+
+	w := &bitWriter{}
+	w.buf = append(w.buf, "fLaC"...)
+
+	// STREAMINFO, the only (and last) metadata block
+	w.writeBits(1, 1)   // last block
+	w.writeBits(0, 7)   // type STREAMINFO
+	w.writeBits(34, 24) // length
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(flacBlockSize, 16)
+	w.writeBits(0, 24) // min frame size unknown
+	w.writeBits(0, 24) // max frame size unknown
+	w.writeBits(uint64(sampleRate), 20)
+	w.writeBits(0, 3)  // channels-1
+	w.writeBits(15, 5) // bits per sample-1
+	w.writeBits(uint64(n), 36)
+	w.writeBits(0, 64) // MD5 unknown
+	w.writeBits(0, 64)
+
+	for frame, off := 0, 0; off < n; frame, off = frame+1, off+flacBlockSize {
+		end := min(off+flacBlockSize, n)
+		writeFLACFrame(w, frame, samples[off:end])
+	}
+	return w.buf
+}
+
+func writeFLACFrame(w *bitWriter, frameNum int, block []int32) {
+	start := len(w.buf)
+
+	w.writeBits(0xFFF8, 16) // sync + reserved + fixed blocksize
+	w.writeBits(0x7, 4)     // blocksize: 16-bit value at end of header
+	w.writeBits(0x0, 4)     // sample rate: from STREAMINFO
+	w.writeBits(0x0, 4)     // mono
+	w.writeBits(0x4, 3)     // 16 bits per sample
+	w.writeBits(0, 1)
+	w.writeUTF8(uint64(frameNum))
+	w.writeBits(uint64(len(block)-1), 16)
+	w.writeBits(uint64(crc8(w.buf[start:])), 8)
+
+	writeFLACSubframe(w, block)
+
+	w.align()
+	w.writeBits(uint64(crc16(w.buf[start:])), 16)
+}
+
+func writeFLACSubframe(w *bitWriter, block []int32) {
+	// Pick the fixed predictor order with the smallest residual.
+	bestOrder, bestBits, bestK := -1, len(block)*16, 0
+	var bestRes []int64
+	for order := 0; order <= 4 && order < len(block); order++ {
+		res := fixedResidual(block, order)
+		k, bits := riceParam(res)
+		bits += order*16 + 2 + 4 + 4
+		if bits < bestBits {
+			bestOrder, bestBits, bestK, bestRes = order, bits, k, res
+		}
+	}
+
+	w.writeBits(0, 1) // padding
+	if bestOrder < 0 {
+		w.writeBits(0x01, 6) // verbatim
+		w.writeBits(0, 1)    // no wasted bits
+		for _, s := range block {
+			w.writeBits(uint64(uint16(s)), 16)
+		}
+		return
+	}
+
+	w.writeBits(uint64(0x08|bestOrder), 6) // fixed, order
+	w.writeBits(0, 1)
+	for _, s := range block[:bestOrder] {
+		w.writeBits(uint64(uint16(s)), 16)
+	}
+	w.writeBits(0, 2) // Rice, 4-bit parameter
+	w.writeBits(0, 4) // partition order 0
+	w.writeBits(uint64(bestK), 4)
+	for _, r := range bestRes {
+		u := uint64((r << 1) ^ (r >> 63))
+		w.writeUnary(u >> bestK)
+		w.writeBits(u&(1<<bestK-1), bestK)
+	}
+}
+
+// fixedResidual applies FLAC's fixed polynomial predictor of the given
+// order and returns the residual for samples[order:].
+func fixedResidual(s []int32, order int) []int64 {
+	res := make([]int64, 0, len(s)-order)
+	for i := order; i < len(s); i++ {
+		x := int64(s[i])
+		var p int64
+		switch order {
+		case 1:
+			p = int64(s[i-1])
+		case 2:
+			p = 2*int64(s[i-1]) - int64(s[i-2])
+		case 3:
+			p = 3*int64(s[i-1]) - 3*int64(s[i-2]) + int64(s[i-3])
+		case 4:
+			p = 4*int64(s[i-1]) - 6*int64(s[i-2]) + 4*int64(s[i-3]) - int64(s[i-4])
+		}
+		res = append(res, x-p)
+	}
+	return res
+}
+
+// riceParam chooses the Rice parameter minimising the encoded size and
+// returns it with that size in bits.
+func riceParam(res []int64) (int, int) {
+	bestK, bestBits := 0, -1
+	for k := 0; k <= 14; k++ {
+		bits := 0
+		for _, r := range res {
+			u := uint64((r << 1) ^ (r >> 63))
+			bits += int(u>>k) + 1 + k
+		}
+		if bestBits < 0 || bits < bestBits {
+			bestK, bestBits = k, bits
+		}
+	}
+	return bestK, bestBits
+}
+
+type bitWriter struct {
+	buf   []byte
+	acc   uint64
+	nbits uint
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for n > 0 {
+		take := min(n, 8)
+		n -= take
+		w.acc = w.acc<<uint(take) | (v>>uint(n))&(1<<uint(take)-1)
+		w.nbits += uint(take)
+		for w.nbits >= 8 {
+			w.nbits -= 8
+			w.buf = append(w.buf, byte(w.acc>>w.nbits))
+		}
+	}
+}
+
+func (w *bitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		w.writeBits(0, 32)
+	}
+	w.writeBits(1, int(q)+1)
+}
+
+// writeUTF8 writes v using FLAC's extended UTF-8 coding (frame numbers).
+func (w *bitWriter) writeUTF8(v uint64) {
+	w.align()
+	switch {
+	case v < 0x80:
+		w.writeBits(v, 8)
+	case v < 0x800:
+		w.writeBits(0xC0|v>>6, 8)
+		w.writeBits(0x80|v&0x3F, 8)
+	case v < 0x10000:
+		w.writeBits(0xE0|v>>12, 8)
+		w.writeBits(0x80|(v>>6)&0x3F, 8)
+		w.writeBits(0x80|v&0x3F, 8)
+	default:
+		w.writeBits(0xF0|v>>18, 8)
+		w.writeBits(0x80|(v>>12)&0x3F, 8)
+		w.writeBits(0x80|(v>>6)&0x3F, 8)
+		w.writeBits(0x80|v&0x3F, 8)
+	}
+}
+
+// align pads with zero bits to the next byte boundary.
+func (w *bitWriter) align() {
+	if w.nbits > 0 {
+		w.writeBits(0, int(8-w.nbits))
+	}
+}
+
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		crc ^= b
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event is one line of the daemon's event stream (`dictate events`), JSON
+// encoded so status bars and scripts can follow the daemon without polling.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`             // started | stopped | burst_start | burst_end | device_error | level_warning | focus_changed | type_error
+	Reason string    `json:"reason,omitempty"` // why a session stopped, or the error/warning
+}
+
+// eventHub fans events out to connected `events` clients. Slow clients lose
+// events rather than blocking the daemon.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan Event]struct{})}
+}
+
+func (h *eventHub) publish(typ, reason string) {
+	ev := Event{Time: time.Now(), Type: typ, Reason: reason}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (h *eventHub) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 32)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// serveEvents streams events to conn until the client goes away.
+func (h *eventHub) serveEvents(conn net.Conn) {
+	ch, unsubscribe := h.subscribe()
+	defer unsubscribe()
+
+	// Notice a closed client even while no events arrive.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		close(gone)
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case ev := <-ch:
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+// runEvents prints the daemon's event stream, one JSON object per line.
+func runEvents(cfg *Config) {
+	conn, err := net.Dial("unix", cfg.Daemon.Socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot reach daemon at %s: %v\n", cfg.Daemon.Socket, err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("events\n")); err != nil {
+		fmt.Fprintf(os.Stderr, "Write failed: %v\n", err)
+		os.Exit(1)
+	}
+	sc := bufio.NewScanner(conn)
+	for sc.Scan() {
+		fmt.Println(sc.Text())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var errFocusChanged = errors.New("focus moved")
+
+// windowCacheTTL is how long the guard reuses a window lookup. Fragments
+// of one utterance arrive faster than that, and on X11 each lookup runs
+// xdotool three times.
+const windowCacheTTL = 200 * time.Millisecond
+
+// focusGuard stands between transcription and the Typist for one session.
+// It never types into a denied window (password prompts, [typing]
+// deny_class / deny_title): text spoken while one has focus is dropped and
+// typing stays paused until focus moves on. Otherwise it remembers the
+// window that had focus when the session started and, when text arrives
+// while another window has focus, applies [typing] focus_guard:
+//
+//	pause      hold the text and type it once the original window is back
+//	clipboard  copy the text to the clipboard instead of typing it
+//	stop       copy the text to the clipboard and stop the session
+//	off        type into whatever has focus
+//
+// Text held when the session ends goes to the clipboard. Everything typed
+// or held is in the history. If the focused window can't be determined (an
+// unsupported Wayland compositor), focus_guard is off, and the deny list
+// fails closed (see failClosed): text is held until the window can be
+// checked.
+type focusGuard struct {
+	policy string
+	cfg    TypingConfig
+	deny   *windowDenyList
+	typist *Typist
+	target focusedWindow
+	warn   func(string)    // focus moved away or typing blocked (indicator + event)
+	stop   func(err error) // ends the session
+
+	away      bool
+	blocked   bool
+	blind     bool            // the last window lookup failed
+	typedInto focusedWindow   // where text was last typed, for the history
+	held      strings.Builder // text held while focus is away
+	unchecked strings.Builder // text held because the deny list couldn't be checked
+
+	looked    time.Time // last activeWindow call, cached for windowCacheTTL
+	lookedWin focusedWindow
+	lookedErr error
+}
+
+// newFocusGuard guards typing into target, the window focused at session
+// start (targetErr if it couldn't be determined).
+func newFocusGuard(cfg TypingConfig, typist *Typist, target focusedWindow, targetErr error, warn func(string), stop func(error)) *focusGuard {
+	g := &focusGuard{policy: cfg.FocusGuard, cfg: cfg, deny: cfg.deny, typist: typist, warn: warn, stop: stop}
+	switch g.policy {
+	case "off", "pause", "clipboard", "stop":
+	default:
+		log.Printf("focus: unknown focus_guard %q, using pause", g.policy)
+		g.policy = "pause"
+	}
+	if targetErr != nil {
+		switch {
+		case failClosed(cfg, targetErr):
+			g.lookupFailed(targetErr)
+		case !g.deny.empty():
+			log.Printf("focus: guard off, password prompts not detected: %v", targetErr)
+		case g.policy != "off":
+			log.Printf("focus: guard off: %v", targetErr)
+		}
+		g.policy = "off"
+		return g
+	}
+	g.target = target
+	if g.policy != "off" {
+		log.Printf("focus: typing into %s", target)
+	}
+	return g
+}
+
+// Type types text if the session's window still has focus. It reports
+// whether the text was accepted (typed or held) rather than dropped, and
+// the typist's error.
+func (g *focusGuard) Type(text string) (bool, error) {
+	if g.policy == "off" && g.deny.empty() {
+		return true, g.typeTarget(text, g.target)
+	}
+	w, err := g.window()
+	if err != nil {
+		if !failClosed(g.cfg, err) {
+			// Don't hold text back just because a lookup failed.
+			return true, g.typeTarget(text, g.target)
+		}
+		// The window might be a password prompt: fail closed.
+		g.lookupFailed(err)
+		g.unchecked.WriteString(text)
+		return true, nil
+	}
+	if g.blind {
+		g.blind = false
+		log.Printf("focus: window lookup works again")
+	}
+	if g.denied(w) {
+		return text == "", nil
+	}
+	if g.unchecked.Len() > 0 {
+		text = g.unchecked.String() + text
+		g.unchecked.Reset()
+	}
+	if g.policy == "off" || w.ID == g.target.ID {
+		return true, g.typeTarget(text, w)
+	}
+
+	g.held.WriteString(text)
+	if !g.away {
+		g.away = true
+		msg := fmt.Sprintf("focus moved to %s", w)
+		switch g.policy {
+		case "pause":
+			msg += "; typing paused until you switch back"
+		case "clipboard":
+			msg += "; text goes to the clipboard"
+		}
+		log.Printf("focus: %s", msg)
+		g.warn(msg)
+	}
+	switch g.policy {
+	case "clipboard":
+		g.copyText(g.held.String())
+	case "stop":
+		g.copyText(g.held.String())
+		g.stop(fmt.Errorf("%w to %s", errFocusChanged, w))
+	}
+	return true, nil
+}
+
+// typeTarget types text into w, the session's window (or with the guard
+// off, whatever has focus), after any text held while focus was away.
+func (g *focusGuard) typeTarget(text string, w focusedWindow) error {
+	if g.away {
+		g.away = false
+		log.Printf("focus: back on %s", g.target)
+		if g.policy == "pause" {
+			text = g.held.String() + text
+		}
+		g.held.Reset()
+	}
+	if text != "" {
+		g.typedInto = w
+	}
+	return g.typist.Type(text)
+}
+
+// window returns the focused window, reusing a lookup made less than
+// windowCacheTTL ago.
+func (g *focusGuard) window() (focusedWindow, error) {
+	if time.Since(g.looked) > windowCacheTTL {
+		g.lookedWin, g.lookedErr = activeWindow()
+		g.looked = time.Now()
+	}
+	return g.lookedWin, g.lookedErr
+}
+
+// lookupFailed warns, once per run of failed lookups, that text is being
+// held because the deny list can't be checked.
+func (g *focusGuard) lookupFailed(err error) {
+	if g.blind {
+		return
+	}
+	g.blind = true
+	msg := fmt.Sprintf("typing held: can't check the focused window for password prompts (%v)", err)
+	log.Printf("focus: %s", msg)
+	g.warn(msg)
+}
+
+// denied reports whether w is on the deny list, warning when typing
+// becomes blocked and logging when it resumes.
+func (g *focusGuard) denied(w focusedWindow) bool {
+	why, deny := g.deny.match(w)
+	switch {
+	case deny && !g.blocked:
+		msg := fmt.Sprintf("typing blocked: %s has focus (%s); dictation paused", w, why)
+		log.Printf("focus: %s", msg)
+		g.warn(msg)
+	case !deny && g.blocked:
+		log.Printf("focus: typing resumed")
+	}
+	g.blocked = deny
+	return deny
+}
+
+// sensitiveFocus reports whether a denied window has focus right now. The
+// daemon checks it before a burst so audio spoken into a password prompt
+// isn't even sent to the backend.
+func (g *focusGuard) sensitiveFocus() bool {
+	if g.deny.empty() {
+		return false
+	}
+	w, err := g.window()
+	return err == nil && g.denied(w)
+}
+
+// flush types held text if focus has come back or the window can be
+// checked again. Called between bursts so held text doesn't wait for the
+// next thing said.
+func (g *focusGuard) flush() error {
+	if g.policy == "pause" && g.away || g.unchecked.Len() > 0 {
+		_, err := g.Type("")
+		return err
+	}
+	return nil
+}
+
+// close puts text that was never typed on the clipboard.
+func (g *focusGuard) close() {
+	if err := g.flush(); err != nil {
+		log.Printf("focus: %v", err)
+	}
+	rest := g.unchecked.String()
+	if g.policy != "clipboard" && g.policy != "stop" {
+		rest = g.held.String() + rest // otherwise already on the clipboard
+	}
+	if rest != "" && g.copyText(rest) {
+		log.Printf("focus: %d chars not typed; copied to the clipboard", len(rest))
+	}
+}
+
+func (g *focusGuard) copyText(text string) bool {
+	if err := copyToClipboard(text); err != nil {
+		log.Printf("focus: %d chars not typed; clipboard: %v", len(text), err)
+		return false
+	}
+	return true
+}
+
+// copyToClipboard uses wl-copy on Wayland and xclip (or xsel) on X11.
+func copyToClipboard(text string) error {
+	cmds := [][]string{{"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmds = [][]string{{"wl-copy"}}
+	}
+	var err error
+	for _, c := range cmds {
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		if err = cmd.Run(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyEntry is one transcribed burst as it was typed. The history file
+// is JSON lines, appended by the daemon and never rewritten.
+type historyEntry struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"` // session start, as in the archive dir name
+	Backend string    `json:"backend"`
+	Window  string    `json:"window,omitempty"` // window the text was typed into, if known
+	Text    string    `json:"text"`
+}
+
+func (c HistoryConfig) path() string {
+	if c.File != "" {
+		return c.File
+	}
+	return filepath.Join(stateDir(), "history.jsonl")
+}
+
+// historyLog appends entries for the daemon. A nil *historyLog records
+// nothing.
+type historyLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newHistoryLog(cfg HistoryConfig) *historyLog {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &historyLog{path: cfg.path()}
+}
+
+func (h *historyLog) add(e historyEntry) {
+	if h == nil || e.Text == "" {
+		return
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("history: %v", err)
+	}
+}
+
+// readHistory loads all entries, oldest first. Lines that don't parse (a
+// write cut short by a crash) are skipped.
+func readHistory(path string) ([]historyEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []historyEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var e historyEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+// historyText returns entry n, counting back from the most recent (1), for
+// `dictate last` and `dictate retype N`.
+func historyText(cfg HistoryConfig, n int) (string, error) {
+	entries, err := readHistory(cfg.path())
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 0 {
+		return "", errors.New("history is empty")
+	}
+	if n < 1 || n > len(entries) {
+		return "", fmt.Errorf("no entry %d (history has %d)", n, len(entries))
+	}
+	return entries[len(entries)-n].Text, nil
+}
+
+// runHistory lists, searches and exports the transcript history. Entries
+// are numbered back from the most recent, the same numbers `dictate retype`
+// takes, so they stay stable while searching.
+func runHistory(cfg *Config, args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	n := fs.Int("n", 20, "show the N most recent matching entries (0 = all)")
+	search := fs.String("search", "", "only entries whose text or window contains this (case-insensitive)")
+	format := fs.String("format", "text", "text | json | markdown")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dictate history [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	switch *format {
+	case "text", "json", "markdown", "md":
+	default:
+		log.Fatalf("unknown format %q (want text, json or markdown)", *format)
+	}
+
+	entries, err := readHistory(cfg.History.path())
+	if err != nil {
+		log.Fatalf("history: %v", err)
+	}
+
+	type numbered struct {
+		N int `json:"n"`
+		historyEntry
+	}
+	var list []numbered
+	q := strings.ToLower(*search)
+	for i, e := range entries {
+		if q != "" && !strings.Contains(strings.ToLower(e.Text), q) && !strings.Contains(strings.ToLower(e.Window), q) {
+			continue
+		}
+		list = append(list, numbered{len(entries) - i, e})
+	}
+	if *n > 0 && len(list) > *n {
+		list = list[len(list)-*n:]
+	}
+
+	switch *format {
+	case "json":
+		if list == nil {
+			list = []numbered{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(list)
+	case "markdown", "md":
+		fmt.Println("# Dictation history")
+		session := ""
+		for _, e := range list {
+			if e.Session != session {
+				session = e.Session
+				fmt.Printf("\n## %s (%s)\n\n", e.Time.Format("2006-01-02 15:04"), e.Backend)
+			}
+			where := ""
+			if e.Window != "" {
+				where = fmt.Sprintf(" _%s_", e.Window)
+			}
+			fmt.Printf("- **%s**%s %s\n", e.Time.Format("15:04:05"), where, strings.TrimSpace(e.Text))
+		}
+	default:
+		if len(list) == 0 {
+			fmt.Fprintln(os.Stderr, "No history entries.")
+			return
+		}
+		for _, e := range list {
+			where := ""
+			if e.Window != "" {
+				where = fmt.Sprintf(" [%s]", e.Window)
+			}
+			fmt.Printf("%4d  %s%s  %s\n", e.N, e.Time.Format("2006-01-02 15:04:05"), where, strings.TrimSpace(e.Text))
+		}
+	}
+}
@@ -8,9 +8,14 @@ import (
 	"strings"
 )
 
+// Indicator shows whether dictation is active. Off gets the reason when a
+// session stopped on its own (idle, screen locked, error), or "" when the
+// user turned it off. Error reports a problem during a session (such as
+// the microphone disappearing) that does not necessarily end it.
 type Indicator interface {
 	On()
-	Off()
+	Off(reason string)
+	Error(msg string)
 	Close()
 }
 
@@ -41,9 +46,15 @@ func (s *IndicatorSet) On() {
 	}
 }
 
-func (s *IndicatorSet) Off() {
+func (s *IndicatorSet) Off(reason string) {
 	for _, ind := range s.indicators {
-		ind.Off()
+		ind.Off(reason)
+	}
+}
+
+func (s *IndicatorSet) Error(msg string) {
+	for _, ind := range s.indicators {
+		ind.Error(msg)
 	}
 }
 
@@ -93,7 +104,7 @@ func (l *ledIndicator) On() {
 	}
 }
 
-func (l *ledIndicator) Off() {
+func (l *ledIndicator) Off(reason string) {
 	restore := "off"
 	if l.savedWasOn {
 		restore = "on"
@@ -104,8 +115,11 @@ func (l *ledIndicator) Off() {
 	}
 }
 
+// Error is a no-op: the LED has no way to show it beyond being on.
+func (l *ledIndicator) Error(msg string) {}
+
 func (l *ledIndicator) Close() {
-	l.Off()
+	l.Off("")
 }
 
 // --- Dunstify indicator ---
@@ -115,7 +129,10 @@ type dunstifyIndicator struct {
 	urgency string
 }
 
-const dunstifyReplaceID = "999111"
+const (
+	dunstifyReplaceID = "999111"
+	dunstifyErrorID   = "999112"
+)
 
 func newDunstifyIndicator(c IndicatorConfig) *dunstifyIndicator {
 	msg := c.Message
@@ -136,15 +153,29 @@ func (d *dunstifyIndicator) On() {
 	}
 }
 
-func (d *dunstifyIndicator) Off() {
+func (d *dunstifyIndicator) Off(reason string) {
 	cmd := exec.Command("dunstify", "-C", dunstifyReplaceID)
+	if reason != "" {
+		// Replace the persistent notification with one that explains why
+		// dictation stopped and then expires.
+		cmd = exec.Command("dunstify", "-a", "dictate", "-r", dunstifyReplaceID, "-t", "5000", "-u", "normal",
+			"Dictation stopped: "+reason)
+	}
 	if err := cmd.Run(); err != nil {
 		log.Printf("indicator/dunstify: off: %v", err)
 	}
 }
 
+func (d *dunstifyIndicator) Error(msg string) {
+	cmd := exec.Command("dunstify", "-a", "dictate", "-r", dunstifyErrorID, "-t", "5000", "-u", "critical",
+		"Dictation: "+msg)
+	if err := cmd.Run(); err != nil {
+		log.Printf("indicator/dunstify: error: %v", err)
+	}
+}
+
 func (d *dunstifyIndicator) Close() {
-	d.Off()
+	d.Off("")
 }
 
 // --- Command indicator ---
@@ -152,10 +183,11 @@ func (d *dunstifyIndicator) Close() {
 type commandIndicator struct {
 	startCmd string
 	stopCmd  string
+	errorCmd string
 }
 
 func newCommandIndicator(c IndicatorConfig) *commandIndicator {
-	return &commandIndicator{startCmd: c.StartCmd, stopCmd: c.StopCmd}
+	return &commandIndicator{startCmd: c.StartCmd, stopCmd: c.StopCmd, errorCmd: c.ErrorCmd}
 }
 
 func (ci *commandIndicator) On() {
@@ -167,15 +199,31 @@ func (ci *commandIndicator) On() {
 	}
 }
 
-func (ci *commandIndicator) Off() {
+// Off runs stop_cmd with $DICTATE_STOP_REASON set (empty when the user
+// turned dictation off).
+func (ci *commandIndicator) Off(reason string) {
 	if ci.stopCmd == "" {
 		return
 	}
-	if err := exec.Command("sh", "-c", ci.stopCmd).Run(); err != nil {
+	cmd := exec.Command("sh", "-c", ci.stopCmd)
+	cmd.Env = append(os.Environ(), "DICTATE_STOP_REASON="+reason)
+	if err := cmd.Run(); err != nil {
 		log.Printf("indicator/command: stop: %v", err)
 	}
 }
 
+// Error runs error_cmd with $DICTATE_ERROR set.
+func (ci *commandIndicator) Error(msg string) {
+	if ci.errorCmd == "" {
+		return
+	}
+	cmd := exec.Command("sh", "-c", ci.errorCmd)
+	cmd.Env = append(os.Environ(), "DICTATE_ERROR="+msg)
+	if err := cmd.Run(); err != nil {
+		log.Printf("indicator/command: error: %v", err)
+	}
+}
+
 func (ci *commandIndicator) Close() {
-	ci.Off()
+	ci.Off("")
 }
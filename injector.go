@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// injector is a long-lived typing helper that reads commands on stdin in
+// dotool's language ("type TEXT", "key enter"): dotool itself, dotoolc, or
+// any [typing] command that speaks it. Keeping one process per session
+// avoids a process start (and for dotool, a new virtual keyboard) per
+// fragment. It is started on first use and restarted if it dies.
+type injector struct {
+	name string
+	args []string
+
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	exited chan struct{}
+
+	// busyUntil estimates when the helper will have typed everything
+	// sent so far. Writes return once the text is in the pipe, long
+	// before it has been typed.
+	busyUntil time.Time
+}
+
+// injectorByteTime is a generous estimate of how long a helper takes to
+// type one byte of script: dotool holds each key for 8 ms and waits 2 ms
+// between keys, and shifted characters take two.
+const injectorByteTime = 20 * time.Millisecond
+
+// injectorStopGrace is how long stop waits beyond the estimate before it
+// kills the helper.
+const injectorStopGrace = 3 * time.Second
+
+func newInjector(name string, args ...string) *injector {
+	return &injector{name: name, args: args}
+}
+
+func (j *injector) start() error {
+	cmd := exec.Command(j.name, j.args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("typist: started %s (pid %d)", j.name, cmd.Process.Pid)
+
+	exited := make(chan struct{})
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("typist/%s: %s", j.name, sc.Text())
+		}
+	}()
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	j.cmd, j.stdin, j.exited = cmd, stdin, exited
+	return nil
+}
+
+func (j *injector) running() bool {
+	if j.cmd == nil {
+		return false
+	}
+	select {
+	case <-j.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// send writes a script, starting the helper if needed and restarting it
+// once if it has died.
+func (j *injector) send(script string) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if !j.running() {
+			if j.cmd != nil {
+				log.Printf("typist: %s exited; restarting", j.name)
+			}
+			j.stop()
+			if err = j.start(); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(j.stdin, script); err == nil {
+			j.busyUntil = later(j.busyUntil, time.Now()).Add(time.Duration(len(script)) * injectorByteTime)
+			return nil
+		}
+		j.stop()
+	}
+	return err
+}
+
+// stop closes the helper's stdin so it finishes what it was sent and
+// exits. It waits for as long as the queued text should take to type,
+// plus a few seconds, before killing a helper that hangs. The next send
+// starts a new one.
+func (j *injector) stop() {
+	if j.cmd == nil {
+		return
+	}
+	j.stdin.Close()
+	wait := max(time.Until(j.busyUntil), 0) + injectorStopGrace
+	select {
+	case <-j.exited:
+	case <-time.After(wait):
+		log.Printf("typist: %s still running %v after stop; killed", j.name, wait.Round(time.Millisecond))
+		j.cmd.Process.Kill()
+		<-j.exited
+	}
+	j.cmd = nil
+	j.busyUntil = time.Time{}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// dotoolScript turns text into dotool commands. dotool takes one command
+// per line, so line breaks become "key enter" rather than letting dictated
+// text run as commands.
+func dotoolScript(text string) string {
+	var b strings.Builder
+	for i, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		if i > 0 {
+			b.WriteString("key enter\n")
+		}
+		if line != "" {
+			b.WriteString("type " + line + "\n")
+		}
+	}
+	return b.String()
+}
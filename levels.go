@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	clipLevel       = 32767 // |sample| at or above this counts as clipped
+	clipWarnRatio   = 0.01  // warn when over 1% of samples clip...
+	silenceWarnRMS  = 5     // ...or the input is below this RMS (muted mic)...
+	levelWindow     = 5 * time.Second
+	levelWarnWindow = 3 // ...for this many windows in a row
+)
+
+// levelMeter tracks input levels for a session: peak, clipping ratio and
+// average RMS overall, plus per-window checks that warn (once per episode)
+// when clipping or near-silence persists.
+type levelMeter struct {
+	sampleRate int // samples per second, all channels
+	warn       func(string)
+
+	mu      sync.Mutex
+	samples int64
+	clipped int64
+	sumSq   float64
+	peak    int
+
+	// current window
+	winSamples int64
+	winClipped int64
+	winSumSq   float64
+	clipRun    int // consecutive clipping windows
+	quietRun   int // consecutive near-silent windows
+}
+
+func newLevelMeter(sampleRate int, warn func(string)) *levelMeter {
+	return &levelMeter{sampleRate: sampleRate, warn: warn}
+}
+
+// levelStream measures chunks of PCM s16le on their way through.
+func levelStream(ctx context.Context, in <-chan []byte, m *levelMeter) <-chan []byte {
+	out := make(chan []byte, cap(in))
+	go func() {
+		defer close(out)
+		for chunk := range in {
+			m.add(chunk)
+			select {
+			case out <- chunk:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (m *levelMeter) add(pcm []byte) {
+	m.mu.Lock()
+	var msgs []string
+	for i := 0; i+1 < len(pcm); i += 2 {
+		v := int(int16(binary.LittleEndian.Uint16(pcm[i:])))
+		if v < 0 {
+			v = -v
+		}
+		m.peak = max(m.peak, v)
+		if v >= clipLevel {
+			m.clipped++
+			m.winClipped++
+		}
+		sq := float64(v) * float64(v)
+		m.sumSq += sq
+		m.winSumSq += sq
+		m.samples++
+		m.winSamples++
+		if m.winSamples >= int64(levelWindow.Seconds()*float64(m.sampleRate)) {
+			if msg := m.closeWindow(); msg != "" {
+				msgs = append(msgs, msg)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, msg := range msgs {
+		log.Printf("levels: %s", msg)
+		if m.warn != nil {
+			m.warn(msg)
+		}
+	}
+}
+
+// closeWindow evaluates the finished window and returns a warning when a
+// problem has just become persistent.
+func (m *levelMeter) closeWindow() string {
+	ratio := float64(m.winClipped) / float64(m.winSamples)
+	rms := math.Sqrt(m.winSumSq / float64(m.winSamples))
+	m.winSamples, m.winClipped, m.winSumSq = 0, 0, 0
+
+	persisted := func(run *int, bad bool) bool {
+		if !bad {
+			*run = 0
+			return false
+		}
+		*run++
+		return *run == levelWarnWindow
+	}
+	clipping := persisted(&m.clipRun, ratio > clipWarnRatio)
+	quiet := persisted(&m.quietRun, rms < silenceWarnRMS)
+	secs := int(levelWindow.Seconds()) * levelWarnWindow
+	switch {
+	case clipping:
+		return fmt.Sprintf("input is clipping (%.1f%% of samples for %ds); lower the mic gain", ratio*100, secs)
+	case quiet:
+		return fmt.Sprintf("input is near-silent (RMS %.1f for %ds); is the mic muted or the wrong device?", rms, secs)
+	}
+	return ""
+}
+
+// String summarises the session's levels for `status`.
+func (m *levelMeter) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.samples == 0 {
+		return "no audio yet"
+	}
+	peakDB := 20 * math.Log10(math.Max(float64(m.peak), 1)/32768)
+	return fmt.Sprintf("peak %.1f dBFS, clipping %.2f%%, avg RMS %.0f over %s",
+		peakDB, float64(m.clipped)/float64(m.samples)*100,
+		math.Sqrt(m.sumSq/float64(m.samples)),
+		time.Duration(float64(m.samples)/float64(m.sampleRate)*float64(time.Second)).Truncate(time.Second))
+}
@@ -2,13 +2,15 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strconv"
 )
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "usage: dictate <daemon|toggle|test FILE>\n")
+		fmt.Fprintf(os.Stderr, "usage: dictate <daemon|toggle|status|test FILE|transcribe FILE|calibrate|events|devices|history|last|retype N>\n")
 		os.Exit(1)
 	}
 
@@ -16,23 +18,53 @@ func main() {
 	case "daemon":
 		cfg := mustLoadConfig()
 		runDaemon(cfg)
-	case "toggle":
+	case "toggle", "status":
 		cfg := mustLoadConfig()
-		runToggle(cfg)
+		runCommand(cfg, os.Args[1])
 	case "test":
 		if len(os.Args) < 3 {
-			fmt.Fprintf(os.Stderr, "usage: dictate test FILE.pcm\n")
+			fmt.Fprintf(os.Stderr, "usage: dictate test FILE (.wav, .flac, .ogg or raw s16le .pcm)\n")
 			os.Exit(1)
 		}
 		cfg := mustLoadConfig()
 		runTest(cfg, os.Args[2])
+	case "transcribe":
+		cfg := mustLoadConfig()
+		runTranscribe(cfg, os.Args[2:])
+	case "calibrate":
+		cfg := mustLoadConfig()
+		runCalibrate(cfg, os.Args[2:])
+	case "events":
+		cfg := mustLoadConfig()
+		runEvents(cfg)
+	case "devices":
+		cfg := mustLoadConfig()
+		runDevices(cfg)
+	case "history":
+		cfg := mustLoadConfig()
+		runHistory(cfg, os.Args[2:])
+	case "last":
+		cfg := mustLoadConfig()
+		runCommand(cfg, "last")
+	case "retype":
+		n := 0
+		if len(os.Args) == 3 {
+			n, _ = strconv.Atoi(os.Args[2])
+		}
+		if n < 1 {
+			fmt.Fprintf(os.Stderr, "usage: dictate retype N (N as numbered by `dictate history`; 1 = most recent)\n")
+			os.Exit(1)
+		}
+		cfg := mustLoadConfig()
+		runCommand(cfg, "retype "+strconv.Itoa(n))
 	default:
 		fmt.Fprintf(os.Stderr, "unknown command: %s\n", os.Args[1])
 		os.Exit(1)
 	}
 }
 
-func runToggle(cfg *Config) {
+// runCommand sends a one-shot command to the daemon and prints the reply.
+func runCommand(cfg *Config, cmd string) {
 	conn, err := net.Dial("unix", cfg.Daemon.Socket)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Cannot reach daemon at %s: %v\n", cfg.Daemon.Socket, err)
@@ -40,15 +72,11 @@ func runToggle(cfg *Config) {
 	}
 	defer conn.Close()
 
-	_, err = conn.Write([]byte("toggle\n"))
+	_, err = conn.Write([]byte(cmd + "\n"))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Write failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	buf := make([]byte, 256)
-	n, _ := conn.Read(buf)
-	if n > 0 {
-		fmt.Print(string(buf[:n]))
-	}
+	io.Copy(os.Stdout, conn)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ReplaceRule is one [[text.replace]] (or [[profile.replace]]) rule: a
+// case-insensitive regexp and its replacement, which may use $1 etc.
+type ReplaceRule struct {
+	Pattern string `toml:"pattern"`
+	With    string `toml:"with"`
+
+	re *regexp.Regexp // compiled by compileText
+}
+
+// compileText checks [text] case and compiles the replace rules.
+func compileText(what, caseMode string, rules []ReplaceRule) error {
+	switch caseMode {
+	case "", "keep", "sentence", "none", "lower":
+	default:
+		return fmt.Errorf("%s: unknown case %q (keep, sentence, none, lower)", what, caseMode)
+	}
+	for i := range rules {
+		re, err := regexp.Compile("(?i)" + rules[i].Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: replace pattern %q: %v", what, rules[i].Pattern, err)
+		}
+		rules[i].re = re
+	}
+	return nil
+}
+
+// textFormatter applies the [text] post-processing to transcribed text on
+// its way to the typist: the replace rules in order, then the case mode.
+//
+// Backends emit text in fragments, and a rule such as "open paren" may be
+// split across two of them, so with rules configured the formatter holds
+// text until the end of a sentence (or of the burst, see flush). Without
+// rules, fragments pass straight through.
+type textFormatter struct {
+	rules    []ReplaceRule
+	caseMode string
+
+	pending       strings.Builder // text held for the rules
+	sentenceStart bool            // the next letter starts a sentence
+}
+
+func newTextFormatter(cfg TextConfig) *textFormatter {
+	return &textFormatter{rules: cfg.Replace, caseMode: cfg.Case, sentenceStart: true}
+}
+
+// push returns the part of text that is ready to type, possibly empty.
+func (f *textFormatter) push(text string) string {
+	if len(f.rules) == 0 {
+		return f.applyCase(text)
+	}
+	f.pending.WriteString(text)
+	s := f.pending.String()
+	i := strings.LastIndexAny(s, ".!?\n")
+	if i < 0 {
+		return ""
+	}
+	f.pending.Reset()
+	f.pending.WriteString(s[i+1:])
+	return f.format(s[:i+1])
+}
+
+// flush returns whatever push is still holding.
+func (f *textFormatter) flush() string {
+	s := f.pending.String()
+	f.pending.Reset()
+	if s == "" {
+		return ""
+	}
+	return f.format(s)
+}
+
+func (f *textFormatter) format(s string) string {
+	for _, r := range f.rules {
+		s = r.re.ReplaceAllString(s, r.With)
+	}
+	return f.applyCase(s)
+}
+
+// applyCase applies the case mode: "sentence" capitalizes the first letter
+// of each sentence, "none" undoes the backend's capitalization of sentence
+// starts (leaving words such as "I", "NASA" or "McDonald" alone) and
+// "lower" lowercases everything. "keep" leaves the text as transcribed.
+func (f *textFormatter) applyCase(s string) string {
+	switch f.caseMode {
+	case "", "keep":
+		return s
+	case "lower":
+		return strings.ToLower(s)
+	}
+	r := []rune(s)
+	for i, c := range r {
+		switch {
+		case unicode.IsLetter(c):
+			if f.sentenceStart {
+				switch f.caseMode {
+				case "sentence":
+					r[i] = unicode.ToUpper(c)
+				case "none":
+					j := i + 1
+					for j < len(r) && unicode.IsLetter(r[j]) {
+						j++
+					}
+					if j-i > 1 && isLowerWord(r[i+1:j]) {
+						r[i] = unicode.ToLower(c)
+					}
+				}
+			}
+			f.sentenceStart = false
+		case unicode.IsDigit(c):
+			f.sentenceStart = false
+		case c == '.' || c == '!' || c == '?' || c == '\n':
+			f.sentenceStart = true
+		}
+	}
+	return string(r)
+}
+
+func isLowerWord(r []rune) bool {
+	for _, c := range r {
+		if !unicode.IsLower(c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// compileProfiles compiles the [[profile]] class and title patterns and
+// text rules, so that mistakes are reported when the config is loaded.
+func compileProfiles(profiles []ProfileConfig) error {
+	for i := range profiles {
+		p := &profiles[i]
+		if p.Class == "" && p.Title == "" {
+			return fmt.Errorf("profile %q: needs class or title", p.Name)
+		}
+		var err error
+		if p.class, err = compileMatch(p.Class); err != nil {
+			return fmt.Errorf("profile %q: class: %v", p.Name, err)
+		}
+		if p.title, err = compileMatch(p.Title); err != nil {
+			return fmt.Errorf("profile %q: title: %v", p.Name, err)
+		}
+		if err := compileText(fmt.Sprintf("profile %q", p.Name), p.Case, p.Replace); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileMatch compiles a case-insensitive pattern; empty gives nil,
+// which matches anything.
+func compileMatch(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("(?i)" + pattern)
+}
+
+// matchProfile returns the first [[profile]] whose class and title
+// patterns (case-insensitive regexps; empty matches anything) both match
+// the window, or nil.
+func matchProfile(profiles []ProfileConfig, w focusedWindow) *ProfileConfig {
+	for i := range profiles {
+		p := &profiles[i]
+		if (p.class == nil || p.class.MatchString(w.Class)) &&
+			(p.title == nil || p.title.MatchString(w.Title)) {
+			return p
+		}
+	}
+	return nil
+}
+
+// withProfile returns a copy of cfg with the profile's overrides applied.
+// Backend-specific sections ([backend.NAME]) are shared, so a profile can
+// switch between backends that are already configured.
+func (cfg *Config) withProfile(p *ProfileConfig) *Config {
+	c := *cfg
+	if p.Method != "" {
+		c.Typing.Method = p.Method
+	}
+	if p.FocusGuard != "" {
+		c.Typing.FocusGuard = p.FocusGuard
+	}
+	if p.PasteKey != "" {
+		c.Typing.PasteKey = p.PasteKey
+	}
+	if p.Backend != "" {
+		c.Backend.Name = p.Backend
+	}
+	if p.Language != "" {
+		c.Backend.Language = p.Language
+	}
+	if p.Case != "" {
+		c.Text.Case = p.Case
+	}
+	if len(p.Replace) > 0 {
+		c.Text.Replace = p.Replace
+	}
+	return &c
+}
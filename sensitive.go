@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// promptClasses matches windows that ask for secrets: GnuPG pinentry, the
+// GNOME keyring prompter, polkit agents, ssh-askpass variants and KWallet.
+// Matched on the window class / app_id.
+var promptClasses = regexp.MustCompile(`(?i)pinentry|gcr-prompter|polkit|askpass|kwalletd`)
+
+// windowDenyList decides which windows dictated text must never be typed
+// into: password prompts (unless [typing] block_prompts is off) and the
+// deny_class / deny_title patterns.
+type windowDenyList struct {
+	prompts bool
+	class   []denyPattern
+	title   []denyPattern
+}
+
+type denyPattern struct {
+	src string // as configured, for messages
+	re  *regexp.Regexp
+}
+
+// newWindowDenyList compiles the [typing] deny settings. Config.compile
+// calls it when the config is loaded and keeps the list in TypingConfig.
+func newWindowDenyList(cfg TypingConfig) (*windowDenyList, error) {
+	compile := func(key string, patterns []string) ([]denyPattern, error) {
+		var out []denyPattern
+		for _, p := range patterns {
+			re, err := regexp.Compile("(?i)" + p)
+			if err != nil {
+				return nil, fmt.Errorf("[typing] %s %q: %v", key, p, err)
+			}
+			out = append(out, denyPattern{p, re})
+		}
+		return out, nil
+	}
+	l := &windowDenyList{prompts: cfg.BlockPrompts}
+	var err error
+	if l.class, err = compile("deny_class", cfg.DenyClass); err != nil {
+		return nil, err
+	}
+	if l.title, err = compile("deny_title", cfg.DenyTitle); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// failClosed reports whether text must be held rather than typed when the
+// focused window couldn't be looked up (err). A failed lookup fails closed
+// while anything is denied; on a desktop that can't report the focused
+// window at all, only with [typing] deny_unknown.
+func failClosed(cfg TypingConfig, err error) bool {
+	if cfg.deny.empty() {
+		return false
+	}
+	return cfg.DenyUnknown || !errors.Is(err, errWindowUnsupported)
+}
+
+// empty reports whether nothing is denied. A nil list (config not
+// compiled) is empty.
+func (l *windowDenyList) empty() bool {
+	return l == nil || !l.prompts && len(l.class) == 0 && len(l.title) == 0
+}
+
+// match reports whether w is denied, and why.
+func (l *windowDenyList) match(w focusedWindow) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	if l.prompts && promptClasses.MatchString(w.Class) {
+		return "password prompt", true
+	}
+	for _, p := range l.class {
+		if p.re.MatchString(w.Class) {
+			return "deny_class " + p.src, true
+		}
+	}
+	for _, p := range l.title {
+		if p.re.MatchString(w.Title) {
+			return "deny_title " + p.src, true
+		}
+	}
+	return "", false
+}
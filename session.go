@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a session ends. Anything else (recorder failure, ...) is reported
+// with its error text.
+var (
+	errToggledOff = errors.New("toggled off")
+	errShutdown   = errors.New("daemon shutting down")
+	errIdle       = errors.New("no speech")
+	errMaxLength  = errors.New("maximum session length reached")
+	errLocked     = errors.New("screen locked")
+	errAudioEnded = errors.New("audio stream ended")
+)
+
+// sessionIDLayout names a session after its start time; archive
+// directories and history entries share the ID.
+const sessionIDLayout = "20060102-150405"
+
+// userStop reports whether a session ended because the user asked for it,
+// in which case indicators just turn off instead of explaining why.
+func userStop(cause error) bool {
+	return errors.Is(cause, errToggledOff) || errors.Is(cause, errShutdown)
+}
+
+// sessionActivity tracks speech bursts so a forgotten session can be
+// stopped after [session] idle_minutes without speech.
+type sessionActivity struct {
+	mu      sync.Mutex
+	inBurst bool
+	last    time.Time // start of the session or end of the last burst
+}
+
+func newSessionActivity() *sessionActivity {
+	return &sessionActivity{last: time.Now()}
+}
+
+func (a *sessionActivity) burst(active bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inBurst = active
+	a.last = time.Now()
+}
+
+// idleFor returns how long the session has gone without speech.
+func (a *sessionActivity) idleFor() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inBurst {
+		return 0
+	}
+	return time.Since(a.last)
+}
+
+// enforceSessionPolicy cancels the session when it has been idle too long,
+// has run for max_minutes, or (with stop_on_lock) the screen locks.
+func enforceSessionPolicy(ctx context.Context, cancel context.CancelCauseFunc, cfg SessionConfig, act *sessionActivity) {
+	idle := time.Duration(cfg.IdleMinutes * float64(time.Minute))
+	var deadline <-chan time.Time
+	if cfg.MaxMinutes > 0 {
+		deadline = time.After(time.Duration(cfg.MaxMinutes * float64(time.Minute)))
+	}
+	var locked <-chan struct{}
+	if cfg.StopOnLock {
+		locked = watchScreenLock(ctx)
+	}
+
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			cancel(fmt.Errorf("%w (%v)", errMaxLength, time.Duration(cfg.MaxMinutes*float64(time.Minute))))
+			return
+		case <-locked:
+			cancel(errLocked)
+			return
+		case <-tick.C:
+			if idle > 0 && act.idleFor() >= idle {
+				cancel(fmt.Errorf("%w for %v", errIdle, idle))
+				return
+			}
+		}
+	}
+}
+
+// watchScreenLock follows the freedesktop and GNOME ScreenSaver
+// ActiveChanged signals on the session bus via dbus-monitor. The returned
+// channel is closed when the screen locks; it never fires if dbus-monitor
+// is unavailable.
+func watchScreenLock(ctx context.Context) <-chan struct{} {
+	locked := make(chan struct{})
+	cmd := exec.CommandContext(ctx, "dbus-monitor", "--session",
+		"type='signal',interface='org.freedesktop.ScreenSaver',member='ActiveChanged'",
+		"type='signal',interface='org.gnome.ScreenSaver',member='ActiveChanged'")
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Printf("session: stop_on_lock: cannot watch screen lock: %v", err)
+		return locked
+	}
+
+	go func() {
+		defer cmd.Wait()
+		sc := bufio.NewScanner(stdout)
+		inSignal := false
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			switch {
+			case strings.HasPrefix(line, "signal "):
+				inSignal = strings.Contains(line, "member=ActiveChanged")
+			case inSignal && line == "boolean true":
+				close(locked)
+				return
+			}
+		}
+	}()
+	return locked
+}
@@ -4,22 +4,23 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"os"
 	"time"
 )
 
-// runTest feeds a PCM s16le file through the configured backend
-// and prints transcribed text to stdout (no xdotool needed).
-func runTest(cfg *Config, pcmFile string) {
-	data, err := os.ReadFile(pcmFile)
+// runTest feeds an audio file (WAV, FLAC, Ogg FLAC or raw PCM s16le)
+// through the configured backend and prints transcribed text to stdout
+// (no xdotool needed).
+func runTest(cfg *Config, audioFile string) {
+	sampleRate := cfg.backendSampleRate()
+	data, err := readAudioFile(audioFile, cfg.rawInputFormat(), sampleRate)
 	if err != nil {
-		log.Fatalf("read %s: %v", pcmFile, err)
+		log.Fatalf("read %s: %v", audioFile, err)
 	}
 
 	// Calculate audio duration
 	samples := len(data) / 2 // 16-bit = 2 bytes per sample
-	duration := time.Duration(float64(samples) / float64(cfg.Audio.SampleRate) * float64(time.Second))
-	log.Printf("Audio: %s (%.1fs, %d bytes)", pcmFile, duration.Seconds(), len(data))
+	duration := time.Duration(float64(samples) / float64(sampleRate) * float64(time.Second))
+	log.Printf("Audio: %s (%.1fs, %d bytes)", audioFile, duration.Seconds(), len(data))
 
 	backend, err := NewBackend(cfg)
 	if err != nil {
@@ -27,7 +28,7 @@ func runTest(cfg *Config, pcmFile string) {
 	}
 
 	// Feed audio in chunks to simulate real-time streaming
-	chunkBytes := cfg.Audio.SampleRate * 2 * cfg.Audio.ChunkMs / 1000
+	chunkBytes := sampleRate * 2 * cfg.Audio.ChunkMs / 1000
 	audioCh := make(chan []byte, 64)
 	go func() {
 		defer close(audioCh)
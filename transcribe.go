@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runTranscribe transcribes a long audio file offline: it is split at
+// silences into segments of at most -max-segment seconds, segments are sent
+// to the configured backend with bounded parallelism, and the ordered result
+// is written as text, SRT, WebVTT or JSON. Progress is checkpointed next to
+// the output so an interrupted run picks up where it stopped.
+func runTranscribe(cfg *Config, args []string) {
+	fs := flag.NewFlagSet("transcribe", flag.ExitOnError)
+	out := fs.String("o", "", "output file (default stdout)")
+	format := fs.String("format", "", "txt | srt | vtt | json (default from -o extension, else txt)")
+	jobs := fs.Int("j", 4, "segments transcribed in parallel")
+	maxSeg := fs.Int("max-segment", 30, "maximum segment length in seconds")
+	fresh := fs.Bool("fresh", false, "ignore any saved progress and start over")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: dictate transcribe [flags] FILE\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	input := fs.Arg(0)
+
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(*out)), ".")
+		if *format == "" || *format == "text" {
+			*format = "txt"
+		}
+	}
+	switch *format {
+	case "txt", "srt", "vtt", "json":
+	default:
+		log.Fatalf("unknown format %q (want txt, srt, vtt or json)", *format)
+	}
+
+	sampleRate := cfg.backendSampleRate()
+	pcm, err := readAudioFile(input, cfg.rawInputFormat(), sampleRate)
+	if err != nil {
+		log.Fatalf("read %s: %v", input, err)
+	}
+	segs := splitAtSilences(pcm, sampleRate, time.Duration(*maxSeg)*time.Second)
+	log.Printf("Audio: %s (%s, %d segments)", input, bytesToDuration(len(pcm), sampleRate).Truncate(time.Second), len(segs))
+
+	// The batch backends cut their input every chunk_seconds. Have them
+	// send each segment whole, so the cuts stay at the silences found here.
+	segCfg := *cfg
+	segCfg.Backend.MistralBatch.ChunkSeconds = max(segCfg.Backend.MistralBatch.ChunkSeconds, *maxSeg+1)
+	segCfg.Backend.LlamaCpp.ChunkSeconds = max(segCfg.Backend.LlamaCpp.ChunkSeconds, *maxSeg+1)
+
+	// Resume state lives next to the output (or the input when writing to
+	// stdout) and is keyed on the audio and segmentation.
+	statePath := input + ".transcribe.json"
+	if *out != "" {
+		statePath = *out + ".partial.json"
+	}
+	state := &transcribeState{Key: transcribeKey(pcm, segs, cfg.Backend.Name)}
+	if !*fresh {
+		if prev, err := loadTranscribeState(statePath); err == nil && prev.Key == state.Key {
+			state = prev
+			log.Printf("Resuming: %d/%d segments already done (%s)", len(state.Done), len(segs), statePath)
+		}
+	}
+	if state.Done == nil {
+		state.Done = make(map[int]string)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed error
+	)
+	work := make(chan int)
+	for w := 0; w < max(*jobs, 1); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				seg := segs[i]
+				text, err := transcribeSegment(ctx, &segCfg, pcm[seg.start:seg.end])
+				mu.Lock()
+				if err != nil {
+					if failed == nil {
+						failed = fmt.Errorf("segment %d (%s): %w", i, formatClock(seg.startTime(sampleRate), '.'), err)
+						cancel()
+					}
+				} else {
+					state.Done[i] = text
+					if err := state.save(statePath); err != nil {
+						log.Printf("save progress: %v", err)
+					}
+					log.Printf("segment %d/%d done", len(state.Done), len(segs))
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i, seg := range segs {
+		if _, done := state.Done[i]; done {
+			continue
+		}
+		if seg.silent {
+			log.Printf("segment %d (%s-%s): silent, skipped", i,
+				formatClock(seg.startTime(sampleRate), '.'), formatClock(seg.endTime(sampleRate), '.'))
+			continue
+		}
+		select {
+		case work <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+	if failed != nil {
+		log.Fatalf("transcribe: %v (progress saved to %s; rerun to resume)", failed, statePath)
+	}
+
+	results := make([]transcribedSegment, 0, len(segs))
+	for i, seg := range segs {
+		if text := state.Done[i]; text != "" {
+			results = append(results, transcribedSegment{
+				Start: seg.startTime(sampleRate).Seconds(),
+				End:   seg.endTime(sampleRate).Seconds(),
+				Text:  text,
+			})
+		}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("create %s: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := writeTranscript(w, *format, input, bytesToDuration(len(pcm), sampleRate), results); err != nil {
+		log.Fatalf("write: %v", err)
+	}
+	os.Remove(statePath)
+}
+
+// transcribeSegment runs one segment through a fresh backend, retrying
+// transient failures with backoff.
+func transcribeSegment(ctx context.Context, cfg *Config, pcm []byte) (string, error) {
+	backoff := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt < 3; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		backend, err := NewBackend(cfg)
+		if err != nil {
+			return "", err
+		}
+
+		chunkBytes := cfg.backendSampleRate() * 2 * cfg.Audio.ChunkMs / 1000
+		audioCh := make(chan []byte, 16)
+		go func() {
+			defer close(audioCh)
+			for i := 0; i < len(pcm); i += chunkBytes {
+				select {
+				case audioCh <- pcm[i:min(i+chunkBytes, len(pcm))]:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		textCh := make(chan string, 32)
+		done := make(chan error, 1)
+		go func() {
+			defer close(textCh)
+			done <- backend.Transcribe(ctx, audioCh, textCh)
+		}()
+		var sb strings.Builder
+		for text := range textCh {
+			sb.WriteString(text)
+		}
+		if lastErr = <-done; lastErr == nil {
+			return strings.TrimSpace(sb.String()), ctx.Err()
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		log.Printf("segment failed (attempt %d): %v", attempt+1, lastErr)
+	}
+	return "", lastErr
+}
+
+// audioSegment is a byte range of PCM s16le mono audio.
+type audioSegment struct {
+	start, end int
+	silent     bool // no frame within 30 dB of the file's speech level; not worth sending
+}
+
+// silenceMarginDB is how far below the file's speech level (its 95th
+// percentile frame RMS) a whole segment must stay to be skipped as silent.
+// Relative to the file, so quiet recordings don't lose segments.
+const silenceMarginDB = 30
+
+func (s audioSegment) startTime(rate int) time.Duration { return bytesToDuration(s.start, rate) }
+func (s audioSegment) endTime(rate int) time.Duration   { return bytesToDuration(s.end, rate) }
+
+func bytesToDuration(n, rate int) time.Duration {
+	return time.Duration(float64(n/2) / float64(rate) * float64(time.Second))
+}
+
+// splitAtSilences cuts pcm into segments no longer than maxLen. Each cut is
+// placed at the quietest 30 ms frame in the second half of the allowed
+// window, so words are not split unless the speaker never pauses.
+func splitAtSilences(pcm []byte, rate int, maxLen time.Duration) []audioSegment {
+	frameBytes := rate * 30 / 1000 * 2
+	threshold := speechLevel(pcm, frameBytes) * math.Pow(10, -silenceMarginDB/20.0)
+	maxBytes := int(maxLen.Seconds()*float64(rate)) * 2
+	maxBytes -= maxBytes % frameBytes
+	if maxBytes < frameBytes*4 {
+		maxBytes = frameBytes * 4
+	}
+
+	var segs []audioSegment
+	for start := 0; start < len(pcm); {
+		end := len(pcm)
+		if end-start > maxBytes {
+			end = start + maxBytes
+			bestRMS := -1.0
+			for off := start + maxBytes/2; off+frameBytes <= start+maxBytes; off += frameBytes {
+				if rms := rmsEnergy(pcm[off : off+frameBytes]); bestRMS < 0 || rms < bestRMS {
+					bestRMS, end = rms, off+frameBytes/2
+				}
+			}
+			end -= end % 2
+		}
+
+		silent := true
+		for off := start; off < end; off += frameBytes {
+			if rmsEnergy(pcm[off:min(off+frameBytes, end)]) > threshold {
+				silent = false
+				break
+			}
+		}
+		segs = append(segs, audioSegment{start: start, end: end, silent: silent})
+		start = end
+	}
+	return segs
+}
+
+// speechLevel returns the 95th percentile of the frame RMS levels in pcm:
+// roughly how loud speech is in this recording.
+func speechLevel(pcm []byte, frameBytes int) float64 {
+	var levels []float64
+	for off := 0; off+frameBytes <= len(pcm); off += frameBytes {
+		levels = append(levels, rmsEnergy(pcm[off:off+frameBytes]))
+	}
+	if len(levels) == 0 {
+		return 0
+	}
+	sort.Float64s(levels)
+	return levels[len(levels)*95/100]
+}
+
+// --- resume state ---
+
+type transcribeState struct {
+	Key  string         `json:"key"`
+	Done map[int]string `json:"done"`
+}
+
+// transcribeKey identifies a run: same audio, same cuts, same backend.
+func transcribeKey(pcm []byte, segs []audioSegment, backend string) string {
+	h := sha256.New()
+	h.Write(pcm)
+	for _, s := range segs {
+		fmt.Fprintf(h, "%d-%d,", s.start, s.end)
+	}
+	h.Write([]byte(backend))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadTranscribeState(path string) (*transcribeState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st transcribeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// save writes the state atomically so a crash never leaves it truncated.
+func (st *transcribeState) save(path string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// --- output formats ---
+
+type transcribedSegment struct {
+	Start float64 `json:"start"` // seconds
+	End   float64 `json:"end"`
+	Text  string  `json:"text"`
+}
+
+func writeTranscript(w io.Writer, format, input string, duration time.Duration, segs []transcribedSegment) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{
+			"file":     input,
+			"duration": duration.Seconds(),
+			"segments": segs,
+		})
+	case "srt":
+		for i, s := range segs {
+			fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", i+1,
+				formatClock(seconds(s.Start), ','), formatClock(seconds(s.End), ','), s.Text)
+		}
+	case "vtt":
+		fmt.Fprintf(w, "WEBVTT\n\n")
+		for _, s := range segs {
+			fmt.Fprintf(w, "%s --> %s\n%s\n\n",
+				formatClock(seconds(s.Start), '.'), formatClock(seconds(s.End), '.'), s.Text)
+		}
+	default:
+		for _, s := range segs {
+			fmt.Fprintln(w, s.Text)
+		}
+	}
+	return nil
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// formatClock renders d as HH:MM:SS,mmm (SRT) or HH:MM:SS.mmm (WebVTT).
+func formatClock(d time.Duration, sep byte) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%c%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
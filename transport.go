@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// TransportConfig holds the network settings shared by all HTTP and
+// WebSocket backends. Each backend has its own [backend.NAME.transport]
+// block so e.g. the cloud backend can use a proxy while a local server
+// is reached directly.
+type TransportConfig struct {
+	Proxy              string            `toml:"proxy"`     // http(s)://host:port; empty = $HTTPS_PROXY/$HTTP_PROXY
+	CAFile             string            `toml:"ca_file"`   // extra PEM CA bundle, appended to system roots
+	CertFile           string            `toml:"cert_file"` // client certificate for mTLS
+	KeyFile            string            `toml:"key_file"`  // client key for mTLS
+	InsecureSkipVerify bool              `toml:"insecure_skip_verify"`
+	ConnectTimeoutSec  int               `toml:"connect_timeout_seconds"` // TCP+TLS handshake; 0 = 10s
+	RequestTimeoutSec  int               `toml:"request_timeout_seconds"` // whole HTTP request; 0 = none
+	IdleTimeoutSec     int               `toml:"idle_timeout_seconds"`    // idle keep-alive / WS read; 0 = 90s HTTP, none WS
+	Headers            map[string]string `toml:"headers"`                 // extra headers sent on every request
+}
+
+func (t TransportConfig) connectTimeout() time.Duration {
+	if t.ConnectTimeoutSec <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(t.ConnectTimeoutSec) * time.Second
+}
+
+// idleTimeout returns the configured idle timeout, or 0 if unset.
+func (t TransportConfig) idleTimeout() time.Duration {
+	return time.Duration(t.IdleTimeoutSec) * time.Second
+}
+
+// tlsConfig builds the TLS settings, or returns nil if the defaults apply.
+func (t TransportConfig) tlsConfig() (*tls.Config, error) {
+	if t.CAFile == "" && t.CertFile == "" && !t.InsecureSkipVerify {
+		return nil, nil
+	}
+	tc := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca_file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file %s: no PEM certificates found", t.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client cert: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
+// httpTransport builds an http.Transport honouring proxy, TLS and
+// connect/idle timeouts. Request timeouts are applied by the caller.
+func (t TransportConfig) httpTransport() (*http.Transport, error) {
+	tc, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if t.Proxy != "" {
+		u, err := url.Parse(t.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy %q: %w", t.Proxy, err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	idle := t.idleTimeout()
+	if idle == 0 {
+		idle = 90 * time.Second
+	}
+
+	dialer := &net.Dialer{Timeout: t.connectTimeout(), KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tc,
+		TLSHandshakeTimeout: t.connectTimeout(),
+		IdleConnTimeout:     idle,
+	}, nil
+}
+
+// HTTPClient returns a client for request/response backends.
+func (t TransportConfig) HTTPClient() (*http.Client, error) {
+	tr, err := t.httpTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: tr,
+		Timeout:   time.Duration(t.RequestTimeoutSec) * time.Second,
+	}, nil
+}
+
+// applyHeaders copies the configured extra headers onto h.
+func (t TransportConfig) applyHeaders(h http.Header) {
+	for k, v := range t.Headers {
+		h.Set(k, v)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// typeQueue decouples typing from transcription: handleBurst pushes text
+// as the backend emits it and a single worker types it in order, so a slow
+// injector doesn't stop textCh being read. Fragments that queue up while
+// the typist is busy are joined into one injection. The queue holds at
+// most [typing] queue_max fragments; past that, push waits for the worker
+// rather than dropping text.
+//
+// Text passes through the [text] formatter on its way in; push, wait and
+// close are called from the session goroutine, which owns the formatter.
+//
+// The worker owns the focusGuard; runSession only touches the guard
+// between bursts, after wait has returned.
+type typeQueue struct {
+	guard  *focusGuard
+	format *textFormatter
+	report func(error) // an injection failed
+	ch     chan typeItem
+	done   chan struct{}
+
+	accepted strings.Builder // text accepted since the last wait
+	midLine  bool            // a "transcribed:" line is open on stderr
+	failing  bool            // the last injection failed
+}
+
+// typeItem is text to type, or (with sync set) a marker that wait uses to
+// find out when everything before it has been typed.
+type typeItem struct {
+	text string
+	sync chan string
+}
+
+func newTypeQueue(guard *focusGuard, format *textFormatter, maxLen int, report func(error)) *typeQueue {
+	q := &typeQueue{
+		guard:  guard,
+		format: format,
+		report: report,
+		ch:     make(chan typeItem, max(maxLen, 1)),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// push queues text for typing.
+func (q *typeQueue) push(text string) {
+	if text = q.format.push(text); text == "" {
+		return
+	}
+	q.send(text)
+}
+
+func (q *typeQueue) send(text string) {
+	select {
+	case q.ch <- typeItem{text: text}:
+	default:
+		log.Printf("typing: queue full (%d fragments); waiting for the typist", cap(q.ch))
+		q.ch <- typeItem{text: text}
+	}
+}
+
+// wait blocks until everything pushed so far has been typed (or held or
+// dropped by the guard) and returns the text accepted since the last wait.
+func (q *typeQueue) wait() string {
+	if text := q.format.flush(); text != "" {
+		q.send(text)
+	}
+	reply := make(chan string)
+	q.ch <- typeItem{sync: reply}
+	return <-reply
+}
+
+// close types what is still queued and stops the worker.
+func (q *typeQueue) close() {
+	if text := q.format.flush(); text != "" {
+		q.send(text)
+	}
+	close(q.ch)
+	<-q.done
+}
+
+func (q *typeQueue) run() {
+	defer close(q.done)
+	var next *typeItem
+	for {
+		var it typeItem
+		if next != nil {
+			it, next = *next, nil
+		} else {
+			var ok bool
+			if it, ok = <-q.ch; !ok {
+				return
+			}
+		}
+		if it.sync != nil {
+			q.endLine()
+			if err := q.guard.flush(); err != nil {
+				q.result(err, "held text")
+			}
+			it.sync <- q.accepted.String()
+			q.accepted.Reset()
+			continue
+		}
+
+		// Join whatever else is already waiting, up to the next marker.
+		var b strings.Builder
+		b.WriteString(it.text)
+		n := 1
+	coalesce:
+		for {
+			select {
+			case more, ok := <-q.ch:
+				if !ok {
+					break coalesce
+				}
+				if more.sync != nil {
+					next = &more
+					break coalesce
+				}
+				b.WriteString(more.text)
+				n++
+			default:
+				break coalesce
+			}
+		}
+		q.typeText(b.String(), n)
+	}
+}
+
+func (q *typeQueue) typeText(text string, fragments int) {
+	accepted, err := q.guard.Type(text)
+	if !accepted {
+		return // typing blocked; drop it
+	}
+	q.accepted.WriteString(text)
+	if !q.midLine {
+		fmt.Fprintf(os.Stderr, "%s transcribed:", time.Now().Format("2006/01/02 15:04:05"))
+		q.midLine = true
+	}
+	fmt.Fprint(os.Stderr, text)
+	q.result(err, fmt.Sprintf("%d fragment(s) %q", fragments, text))
+}
+
+// result logs a failed injection of what and reports the first failure of
+// a run.
+func (q *typeQueue) result(err error, what string) {
+	if err != nil {
+		q.endLine()
+		log.Printf("typing: %s not typed: %v", what, err)
+		if !q.failing {
+			q.report(err) // once per run of failures
+		}
+	} else if q.failing {
+		log.Printf("typing: working again")
+	}
+	q.failing = err != nil
+}
+
+func (q *typeQueue) endLine() {
+	if q.midLine {
+		fmt.Fprintln(os.Stderr)
+		q.midLine = false
+	}
+}
@@ -3,22 +3,36 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Typist injects text as keystrokes into the focused window.
 type Typist struct {
-	method    string
-	ydotoold  *exec.Cmd // managed ydotoold process, if we started it
+	method   string
+	command  string     // method "command": helper speaking dotool's stdin language
+	pasteKey string     // method "paste": key combination that pastes
+	ydotoold *exec.Cmd  // managed ydotoold process, if we started it
+	mu       sync.Mutex // one injection at a time (bursts and retype)
+	inj      *injector  // long-lived dotool/command helper, if persistent
 }
 
 func NewTypist(cfg TypingConfig) *Typist {
-	t := &Typist{method: cfg.Method}
+	t := &Typist{method: cfg.Method, command: cfg.Command, pasteKey: cfg.PasteKey}
 	if cfg.Method == "ydotool" {
 		t.ensureYdotoold()
 	}
+	if cfg.Persistent {
+		switch cfg.Method {
+		case "dotool":
+			t.inj = newInjector("dotool")
+		case "command":
+			t.inj = newInjector("sh", "-c", cfg.Command)
+		}
+	}
 	return t
 }
 
@@ -40,8 +54,19 @@ func (t *Typist) ensureYdotoold() {
 	go cmd.Wait()
 }
 
-// Close stops ydotoold if we started it.
+// Release stops the persistent helper, if any, once a session is over.
+// The next Type starts a new one.
+func (t *Typist) Release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.inj != nil {
+		t.inj.stop()
+	}
+}
+
+// Close stops the persistent helper and ydotoold if we started them.
 func (t *Typist) Close() {
+	t.Release()
 	if t.ydotoold != nil && t.ydotoold.Process != nil {
 		t.ydotoold.Process.Kill()
 		log.Println("stopped ydotoold")
@@ -49,10 +74,12 @@ func (t *Typist) Close() {
 }
 
 // Type sends text to the focused window.
-func (t *Typist) Type(text string) {
+func (t *Typist) Type(text string) error {
 	if text == "" {
-		return
+		return nil
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	var err error
 	switch t.method {
 	case "xdotool":
@@ -63,12 +90,17 @@ func (t *Typist) Type(text string) {
 		err = t.wtype(text)
 	case "dotool":
 		err = t.dotool(text)
+	case "command":
+		err = t.script(text)
+	case "paste":
+		err = t.paste(text)
 	default:
 		err = fmt.Errorf("unknown typing method: %s", t.method)
 	}
 	if err != nil {
-		log.Printf("typist error (%s): %v", t.method, err)
+		return fmt.Errorf("%s: %w", t.method, err)
 	}
+	return nil
 }
 
 func runCmd(timeout time.Duration, name string, args ...string) error {
@@ -89,9 +121,48 @@ func (t *Typist) wtype(text string) error {
 	return runCmd(10*time.Second, "wtype", "--", text)
 }
 
+// paste copies text to the clipboard and presses paste_key, for windows
+// that take a paste better than a stream of keystrokes (terminals). The
+// key goes through xdotool on X11 and wtype on Wayland.
+func (t *Typist) paste(text string) error {
+	if err := copyToClipboard(text); err != nil {
+		return fmt.Errorf("clipboard: %w", err)
+	}
+	if os.Getenv("WAYLAND_DISPLAY") == "" {
+		return runCmd(10*time.Second, "xdotool", "key", "--clearmodifiers", t.pasteKey)
+	}
+	keys := strings.Split(t.pasteKey, "+")
+	mods, key := keys[:len(keys)-1], keys[len(keys)-1]
+	var args []string
+	for _, m := range mods {
+		args = append(args, "-M", m)
+	}
+	args = append(args, "-k", key)
+	for i := len(mods) - 1; i >= 0; i-- {
+		args = append(args, "-m", mods[i])
+	}
+	return runCmd(10*time.Second, "wtype", args...)
+}
+
 func (t *Typist) dotool(text string) error {
+	if t.inj != nil {
+		return t.inj.send(dotoolScript(text))
+	}
 	cmd := exec.Command("dotool")
-	cmd.Stdin = strings.NewReader("type " + text + "\n")
+	cmd.Stdin = strings.NewReader(dotoolScript(text))
+	cmd.WaitDelay = 10 * time.Second
+	return cmd.Run()
+}
+
+func (t *Typist) script(text string) error {
+	if t.command == "" {
+		return fmt.Errorf("typing method \"command\" needs [typing] command")
+	}
+	if t.inj != nil {
+		return t.inj.send(dotoolScript(text))
+	}
+	cmd := exec.Command("sh", "-c", t.command)
+	cmd.Stdin = strings.NewReader(dotoolScript(text))
 	cmd.WaitDelay = 10 * time.Second
 	return cmd.Run()
 }
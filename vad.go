@@ -3,17 +3,65 @@ package main
 import (
 	"context"
 	"encoding/binary"
+	"fmt"
 	"log"
 	"math"
 )
 
+// VAD decides whether a chunk of audio contains speech. Implementations see
+// every chunk in order and may keep state (noise floor, smoothing).
+type VAD interface {
+	// Speech reports whether chunk contains speech. speaking is true while
+	// a burst is open, so detectors can use a lower release level.
+	Speech(chunk []byte, speaking bool) bool
+	Close()
+}
+
+// NewVAD builds the detector selected by cfg.Detector:
+//
+//	energy   — one RMS value per chunk against a fixed or adaptive level (default)
+//	frame    — per-frame energy + ZCR + spectral features
+//	external — speech probability from a subprocess (e.g. Silero)
+func NewVAD(cfg VADConfig, chunkMs, sampleRate int) (VAD, error) {
+	switch cfg.Detector {
+	case "energy", "":
+		return &energyVAD{levels: newVADLevels(cfg, chunkMs)}, nil
+	case "frame":
+		if cfg.FrameMs <= 0 {
+			return &energyVAD{levels: newVADLevels(cfg, chunkMs)}, nil
+		}
+		return newFrameDetector(cfg, sampleRate), nil
+	case "external":
+		return newExternalVAD(cfg, chunkMs, sampleRate)
+	default:
+		return nil, fmt.Errorf("unknown vad detector: %q", cfg.Detector)
+	}
+}
+
 // vadBursts watches an audio stream and yields speech bursts. Each burst is a
 // channel of audio chunks that starts with pre-buffered audio before speech
 // onset and closes after trailing silence. The caller should connect a backend
 // for each burst, then disconnect when the burst channel closes.
 //
+// Loudness is judged with hysteresis: a chunk must exceed the onset level to
+// start a burst, but only the (lower) release level to keep it going. In
+// "adaptive" mode both levels float above a learned noise floor. The
+// decision itself is made by the configured VAD (see NewVAD); whole chunks
+// are always emitted.
+//
+// A pause of commit_ms inside a burst (shorter than the hangover) marks the
+// end of an utterance: an empty chunk is sent on the burst channel, which
+// realtime backends turn into a flush so the server finalizes the segment
+// without waiting for the burst to close. Other backends ignore it.
+//
+// If denoise is non-nil, every chunk passes through it after the speech
+// decision, and chunks judged silent while no burst is open train its noise
+// profile.
+//
+// If trace is non-nil it is called with every chunk's decision.
+//
 // If VAD is disabled, yields a single burst that mirrors the input forever.
-func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-chan []byte) {
+func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig, chunkMs, sampleRate int, denoise *noiseSuppressor, trace func(speech bool)) <-chan (<-chan []byte) {
 	bursts := make(chan (<-chan []byte), 1)
 
 	if !cfg.Enabled {
@@ -48,31 +96,49 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 
 		type state int
 		const (
-			silent   state = iota
+			silent  state = iota
+			pending       // speech seen, waiting for min_speech_ms before opening a burst
 			speaking
 			trailing
 		)
 
+		// Settings are in milliseconds; the state machine counts chunks.
+		preN := msToChunks(cfg.PreRollMs, chunkMs)
+		trailN := max(msToChunks(cfg.HangoverMs, chunkMs), 1)
+		commitN := msToChunks(cfg.CommitMs, chunkMs)
+
 		st := silent
 		trailLeft := 0
+		quietN := 0       // quiet chunks in the current pause
+		speechMs := 0     // speech accumulated while pending
+		var held [][]byte // chunks accumulated while pending
 		var burst chan []byte
+		vad, err := NewVAD(cfg, chunkMs, sampleRate)
+		if err != nil {
+			log.Printf("vad: %v; falling back to energy detector", err)
+			vad = &energyVAD{levels: newVADLevels(cfg, chunkMs)}
+		}
+		defer vad.Close()
 
 		// Rolling pre-buffer
-		ring := make([][]byte, cfg.PreBufferN)
+		ring := make([][]byte, preN)
 		ringPos := 0
 		ringFull := false
 
 		pushRing := func(chunk []byte) {
+			if preN == 0 {
+				return
+			}
 			ring[ringPos] = chunk
 			ringPos++
-			if ringPos >= cfg.PreBufferN {
+			if ringPos >= preN {
 				ringPos = 0
 				ringFull = true
 			}
 		}
 
 		startBurst := func() chan []byte {
-			ch := make(chan []byte, 16)
+			ch := make(chan []byte, 16+len(held))
 			select {
 			case bursts <- ch:
 			case <-ctx.Done():
@@ -80,7 +146,7 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 				return nil
 			}
 			// Flush pre-buffer
-			n := cfg.PreBufferN
+			n := preN
 			if !ringFull {
 				n = ringPos
 			}
@@ -89,7 +155,7 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 				start = ringPos
 			}
 			for i := 0; i < n; i++ {
-				idx := (start + i) % cfg.PreBufferN
+				idx := (start + i) % preN
 				if ring[idx] != nil {
 					ch <- ring[idx]
 					ring[idx] = nil
@@ -110,6 +176,16 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 			}
 		}
 
+		// pause counts a quiet chunk inside a burst and flushes the
+		// utterance once the pause reaches commit_ms.
+		pause := func() {
+			quietN++
+			if quietN == commitN && quietN < trailN {
+				log.Printf("vad: %dms pause, ending utterance", quietN*chunkMs)
+				emit(utteranceEnd)
+			}
+		}
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -125,26 +201,52 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 					return
 				}
 
-				loud := rmsEnergy(chunk) >= cfg.Threshold
+				loud := vad.Speech(chunk, st == speaking || st == trailing)
+				if trace != nil {
+					trace(loud)
+				}
+				if denoise != nil {
+					chunk = denoise.Process(chunk, st == silent && !loud)
+				}
 
 				switch st {
-				case silent:
-					if loud {
-						st = speaking
-						log.Println("vad: speech started")
-						burst = startBurst()
-						if burst == nil {
-							return
+				case silent, pending:
+					if !loud {
+						if st == pending {
+							// Too short to be speech (cough, click): the held
+							// audio becomes pre-roll for the next attempt.
+							log.Printf("vad: ignored %dms blip (min_speech_ms=%d)", speechMs, cfg.MinSpeechMs)
+							for _, c := range held {
+								pushRing(c)
+							}
+							held, speechMs, st = nil, 0, silent
 						}
-						emit(chunk)
-					} else {
 						pushRing(chunk)
+						break
+					}
+					held = append(held, chunk)
+					speechMs += speechDuration(vad, chunkMs)
+					if speechMs < cfg.MinSpeechMs {
+						st = pending
+						break
 					}
+					st = speaking
+					log.Println("vad: speech started")
+					burst = startBurst()
+					if burst == nil {
+						return
+					}
+					for _, c := range held {
+						emit(c)
+					}
+					held, speechMs = nil, 0
 				case speaking:
 					emit(chunk)
 					if !loud {
 						st = trailing
-						trailLeft = cfg.TrailChunks
+						trailLeft = trailN
+						quietN = 0
+						pause()
 					}
 				case trailing:
 					emit(chunk)
@@ -152,6 +254,9 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 						st = speaking
 					} else {
 						trailLeft--
+						if trailLeft > 0 {
+							pause()
+						}
 						if trailLeft <= 0 {
 							st = silent
 							log.Println("vad: speech ended, closing burst")
@@ -167,6 +272,128 @@ func vadBursts(ctx context.Context, in <-chan []byte, cfg VADConfig) <-chan (<-c
 	return bursts
 }
 
+// utteranceEnd is sent on a burst channel at a pause in speech. It is an
+// empty, non-nil chunk so backends that only append audio need no special case.
+var utteranceEnd = []byte{}
+
+// msToChunks converts a duration setting to a whole number of chunks,
+// rounding up so a non-zero setting never becomes zero.
+func msToChunks(ms, chunkMs int) int {
+	if ms <= 0 || chunkMs <= 0 {
+		return 0
+	}
+	return (ms + chunkMs - 1) / chunkMs
+}
+
+// speechMeasurer is implemented by detectors that know how much of the last
+// chunk was speech, which makes min_speech_ms finer than one chunk.
+type speechMeasurer interface {
+	LastSpeechMs() int
+}
+
+// speechDuration returns how much speech the last loud chunk contained.
+func speechDuration(vad VAD, chunkMs int) int {
+	if m, ok := vad.(speechMeasurer); ok {
+		return m.LastSpeechMs()
+	}
+	return chunkMs
+}
+
+// energyVAD is the classic detector: one RMS value per chunk.
+type energyVAD struct {
+	levels *vadLevels
+}
+
+func (v *energyVAD) Speech(chunk []byte, speaking bool) bool {
+	return v.levels.loud(rmsEnergy(chunk), speaking)
+}
+
+func (v *energyVAD) Close() {}
+
+// vadLevels decides whether a chunk is loud, with separate onset and release
+// levels. In adaptive mode the levels track a noise floor estimated as the
+// minimum chunk RMS over a sliding window: speech is never stationary for
+// that long, but a fan switching on raises the floor within one window.
+type vadLevels struct {
+	adaptive bool
+	onset    float64 // fixed levels, or dB margins converted to ratios
+	release  float64
+	minFloor float64
+
+	window []float64 // recent chunk RMS values (ring)
+	pos    int
+	filled bool
+	floor  float64
+	logged float64 // floor at last log line
+}
+
+// newVADLevels builds levels for decisions made every stepMs milliseconds
+// (a chunk or a frame), which sets the length of the noise floor window.
+func newVADLevels(cfg VADConfig, stepMs int) *vadLevels {
+	l := &vadLevels{}
+	if cfg.Mode != "adaptive" {
+		l.onset = cfg.Threshold
+		l.release = cfg.ReleaseThreshold
+		if l.release <= 0 || l.release > l.onset {
+			l.release = l.onset
+		}
+		return l
+	}
+
+	l.adaptive = true
+	l.onset = math.Pow(10, cfg.OnsetMarginDB/20)
+	l.release = math.Pow(10, cfg.ReleaseMarginDB/20)
+	if l.release > l.onset {
+		l.release = l.onset
+	}
+	l.minFloor = max(cfg.MinFloor, 1)
+	n := 1
+	if stepMs > 0 {
+		n = max(int(cfg.FloorWindowSec*1000)/stepMs, 1)
+	}
+	l.window = make([]float64, n)
+	log.Printf("vad: adaptive (onset +%.0f dB, release +%.0f dB, window %.0fs)",
+		cfg.OnsetMarginDB, cfg.ReleaseMarginDB, cfg.FloorWindowSec)
+	return l
+}
+
+// loud reports whether rms counts as speech. speaking selects the release
+// level instead of the onset level.
+func (l *vadLevels) loud(rms float64, speaking bool) bool {
+	if !l.adaptive {
+		if speaking {
+			return rms >= l.release
+		}
+		return rms >= l.onset
+	}
+
+	l.window[l.pos] = rms
+	l.pos++
+	if l.pos == len(l.window) {
+		l.pos, l.filled = 0, true
+	}
+	n := len(l.window)
+	if !l.filled {
+		n = l.pos
+	}
+	floor := l.window[0]
+	for _, v := range l.window[1:n] {
+		floor = min(floor, v)
+	}
+	l.floor = max(floor, l.minFloor)
+
+	if l.logged == 0 || math.Abs(l.floor-l.logged) > l.logged*0.25 {
+		log.Printf("vad: noise floor %.0f (onset %.0f, release %.0f)",
+			l.floor, l.floor*l.onset, l.floor*l.release)
+		l.logged = l.floor
+	}
+
+	if speaking {
+		return rms >= l.floor*l.release
+	}
+	return rms >= l.floor*l.onset
+}
+
 // rmsEnergy computes the root-mean-square energy of PCM s16le audio.
 func rmsEnergy(pcm []byte) float64 {
 	n := len(pcm) / 2
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// externalVAD asks a long-running subprocess (Silero, WebRTC VAD, ...) for
+// a speech probability per chunk. The protocol on the child's stdin/stdout
+// is deliberately trivial so a wrapper is a few lines in any language:
+//
+//	request:  uint32 little-endian byte count, then that many bytes of
+//	          PCM s16le mono at $DICTATE_SAMPLE_RATE
+//	response: float32 little-endian speech probability in [0, 1]
+//
+// One response per request, in order. The child's stderr goes to the daemon
+// log.
+//
+// Speech never holds up the audio for long: it waits at most half a chunk
+// for the reply to the chunk it was given, and judges the chunk with the
+// energy detector if the reply is late (the late reply is discarded when it
+// comes). While the child is busy with earlier chunks, new ones aren't sent.
+// The child gets startup_ms to send its first reply, since loading a model
+// can take a while, and then timeout_ms per reply; if it dies or misses that,
+// the session falls back to the energy detector for good.
+type externalVAD struct {
+	cmd      *exec.Cmd
+	requests chan []byte // framed requests for the stdin writer
+	replies  chan float32
+	onset    float64
+	release  float64
+	wait     time.Duration // longest Speech waits for a reply
+	timeout  time.Duration // a reply this late means the child is stuck
+	startup  time.Duration // the same for the first reply
+	fallback VAD
+	failed   bool
+	close    sync.Once
+
+	started time.Time
+	ready   bool        // the first reply has come
+	sent    []time.Time // requests awaiting a reply, oldest first
+}
+
+// maxExternalPending is how many chunks may be waiting for a reply before
+// further chunks are judged without the child.
+const maxExternalPending = 2
+
+func newExternalVAD(cfg VADConfig, chunkMs, sampleRate int) (*externalVAD, error) {
+	ec := cfg.External
+	if ec.Command == "" {
+		return nil, fmt.Errorf("vad detector \"external\" needs [audio.vad.external] command")
+	}
+
+	cmd := exec.Command("sh", "-c", ec.Command)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("DICTATE_SAMPLE_RATE=%d", sampleRate))
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start external vad: %w", err)
+	}
+	log.Printf("vad: external detector started (pid %d): %s", cmd.Process.Pid, ec.Command)
+
+	timeout := time.Duration(max(ec.TimeoutMs, 1)) * time.Millisecond
+	v := &externalVAD{
+		cmd:      cmd,
+		requests: make(chan []byte, maxExternalPending),
+		replies:  make(chan float32, maxExternalPending),
+		onset:    ec.Onset,
+		release:  min(ec.Release, ec.Onset),
+		wait:     min(time.Duration(chunkMs)*time.Millisecond/2, timeout),
+		timeout:  timeout,
+		startup:  max(time.Duration(ec.StartupMs)*time.Millisecond, timeout),
+		fallback: &energyVAD{levels: newVADLevels(cfg, chunkMs)},
+		started:  time.Now(),
+	}
+
+	go func() {
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			log.Printf("vad/external: %s", sc.Text())
+		}
+	}()
+	go func() {
+		defer stdin.Close()
+		for req := range v.requests {
+			if _, err := stdin.Write(req); err != nil {
+				return // the reader sees the child go
+			}
+		}
+	}()
+	go func() {
+		defer close(v.replies)
+		var buf [4]byte
+		for {
+			if _, err := io.ReadFull(stdout, buf[:]); err != nil {
+				return
+			}
+			v.replies <- math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
+		}
+	}()
+	go cmd.Wait()
+
+	return v, nil
+}
+
+func (v *externalVAD) Speech(chunk []byte, speaking bool) bool {
+	// The energy detector sees every chunk so its state (adaptive floor)
+	// is current whenever its answer is needed.
+	energy := v.fallback.Speech(chunk, speaking)
+	if v.failed {
+		return energy
+	}
+
+	// Replies to chunks already judged without them are stale.
+	for stale := true; stale && len(v.sent) > 0; {
+		select {
+		case _, ok := <-v.replies:
+			if !ok {
+				return v.fail(fmt.Errorf("detector exited"), energy)
+			}
+			v.replied()
+		default:
+			stale = false
+		}
+	}
+	if len(v.sent) > 0 {
+		limit := v.timeout
+		if !v.ready {
+			limit = v.startup
+		}
+		if age := time.Since(v.sent[0]); age > limit {
+			return v.fail(fmt.Errorf("no reply within %v", limit), energy)
+		}
+	}
+	if len(v.sent) >= maxExternalPending {
+		return energy // still busy with earlier chunks
+	}
+
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(chunk)))
+	v.requests <- append(hdr[:], chunk...)
+	v.sent = append(v.sent, time.Now())
+
+	// Replies come in order, so this chunk's is the one that empties sent.
+	deadline := time.NewTimer(v.wait)
+	defer deadline.Stop()
+	for {
+		select {
+		case p, ok := <-v.replies:
+			if !ok {
+				return v.fail(fmt.Errorf("detector exited"), energy)
+			}
+			v.replied()
+			if len(v.sent) > 0 {
+				continue
+			}
+			if speaking {
+				return float64(p) >= v.release
+			}
+			return float64(p) >= v.onset
+		case <-deadline.C:
+			return energy
+		}
+	}
+}
+
+func (v *externalVAD) replied() {
+	v.sent = v.sent[1:]
+	if !v.ready {
+		v.ready = true
+		log.Printf("vad: external detector ready after %v", time.Since(v.started).Round(time.Millisecond))
+	}
+}
+
+// fail switches to the fallback detector for the rest of the session. A
+// late reply would desynchronise the protocol, so the child is killed.
+func (v *externalVAD) fail(err error, energy bool) bool {
+	log.Printf("vad: external detector failed (%v); using energy detector", err)
+	v.failed = true
+	v.Close()
+	return energy
+}
+
+func (v *externalVAD) Close() {
+	v.close.Do(func() {
+		close(v.requests)
+		if v.cmd.Process != nil {
+			v.cmd.Process.Kill()
+		}
+	})
+}
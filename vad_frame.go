@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// frameDetector classifies a chunk by looking at short frames (frame_ms,
+// typically 20 ms) inside it instead of one RMS over the whole chunk, so a
+// 150 ms word in a 480 ms chunk of silence is not averaged away. Each frame
+// must pass the energy level and look like speech spectrally:
+//
+//   - zero-crossing rate below max_zcr (rejects hiss and broadband noise)
+//   - spectral flatness below max_flatness (speech is peaky, noise is flat)
+//   - at least min_band_ratio of its energy in 200-4000 Hz (rejects hum and
+//     fan rumble below the speech band)
+//
+// Frame decisions are smoothed with a majority vote over smooth_frames, and
+// the chunk counts as loud if any smoothed frame is speech.
+type frameDetector struct {
+	levels      *vadLevels
+	frameLen    int // samples per frame
+	sampleRate  int
+	maxZCR      float64
+	maxFlatness float64
+	minBand     float64
+
+	votes   []bool // recent raw frame decisions (ring), spans chunks
+	votePos int
+	frameMs int
+	lastN   int // smoothed speech frames in the last chunk
+
+	window []float64 // analysis window, padded to FFT size
+	spec   []complex128
+}
+
+func newFrameDetector(cfg VADConfig, sampleRate int) *frameDetector {
+	frameLen := max(sampleRate*cfg.FrameMs/1000, 16)
+	n := nextPow2(frameLen)
+	win := make([]float64, n)
+	copy(win, hannWindow(frameLen))
+	return &frameDetector{
+		levels:      newVADLevels(cfg, cfg.FrameMs),
+		frameLen:    frameLen,
+		sampleRate:  sampleRate,
+		maxZCR:      cfg.MaxZCR,
+		maxFlatness: cfg.MaxFlatness,
+		minBand:     cfg.MinBandRatio,
+		votes:       make([]bool, max(cfg.SmoothFrames, 1)),
+		frameMs:     cfg.FrameMs,
+		window:      win,
+		spec:        make([]complex128, n),
+	}
+}
+
+// Speech reports whether chunk contains speech. speaking selects the release
+// energy level (see vadLevels).
+func (d *frameDetector) Speech(chunk []byte, speaking bool) bool {
+	samples := pcmToFloats(chunk)
+	d.lastN = 0
+	// A partial frame at the end of the chunk is ignored; chunk_ms is
+	// normally a multiple of frame_ms.
+	for off := 0; off+d.frameLen <= len(samples); off += d.frameLen {
+		frame := samples[off : off+d.frameLen]
+		d.votes[d.votePos] = d.isSpeech(frame, speaking)
+		d.votePos = (d.votePos + 1) % len(d.votes)
+
+		yes := 0
+		for _, v := range d.votes {
+			if v {
+				yes++
+			}
+		}
+		if yes*2 > len(d.votes) {
+			d.lastN++
+		}
+	}
+	return d.lastN > 0
+}
+
+// LastSpeechMs reports how much of the last chunk was (smoothed) speech.
+func (d *frameDetector) LastSpeechMs() int {
+	return d.lastN * d.frameMs
+}
+
+func (d *frameDetector) Close() {}
+
+func (d *frameDetector) isSpeech(frame []float64, speaking bool) bool {
+	var sum float64
+	crossings := 0
+	for i, s := range frame {
+		sum += s * s
+		if i > 0 && (s >= 0) != (frame[i-1] >= 0) {
+			crossings++
+		}
+	}
+	rms := math.Sqrt(sum / float64(len(frame)))
+	if !d.levels.loud(rms, speaking) {
+		return false
+	}
+	if zcr := float64(crossings) / float64(len(frame)); d.maxZCR > 0 && zcr > d.maxZCR {
+		return false
+	}
+	flatness, band := d.spectralFeatures(frame)
+	if d.maxFlatness > 0 && flatness > d.maxFlatness {
+		return false
+	}
+	return band >= d.minBand
+}
+
+// spectralFeatures returns the spectral flatness (geometric over arithmetic
+// mean of the power spectrum, 0..1) and the share of energy in 200-4000 Hz.
+func (d *frameDetector) spectralFeatures(frame []float64) (flatness, band float64) {
+	for i := range d.spec {
+		v := 0.0
+		if i < len(frame) {
+			v = frame[i] * d.window[i]
+		}
+		d.spec[i] = complex(v, 0)
+	}
+	fft(d.spec)
+
+	n := len(d.spec)
+	hz := float64(d.sampleRate) / float64(n)
+	var total, inBand, logSum float64
+	bins := 0
+	for k := 1; k < n/2; k++ {
+		p := real(d.spec[k])*real(d.spec[k]) + imag(d.spec[k])*imag(d.spec[k])
+		total += p
+		f := float64(k) * hz
+		if f >= 200 && f <= 4000 {
+			inBand += p
+			logSum += math.Log(p + 1e-9)
+			bins++
+		}
+	}
+	if total == 0 || bins == 0 {
+		return 1, 0
+	}
+	arith := inBand / float64(bins)
+	geo := math.Exp(logSum / float64(bins))
+	return geo / (arith + 1e-9), inBand / total
+}
+
+// pcmToFloats converts PCM s16le to float samples in int16 units.
+func pcmToFloats(pcm []byte) []float64 {
+	out := make([]float64, len(pcm)/2)
+	for i := range out {
+		out[i] = float64(int16(binary.LittleEndian.Uint16(pcm[i*2:])))
+	}
+	return out
+}
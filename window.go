@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// focusedWindow describes the window that has keyboard focus. ID tells
+// windows apart (titles change as you work); Class is the X11 WM_CLASS class
+// or the Wayland app_id.
+type focusedWindow struct {
+	ID    string
+	Class string
+	Title string
+}
+
+func (w focusedWindow) String() string {
+	switch {
+	case w.Class == "":
+		return w.Title
+	case w.Title == "":
+		return w.Class
+	}
+	return w.Class + ": " + w.Title
+}
+
+// errWindowUnsupported means the display server has no way to tell which
+// window has focus (GNOME, KDE and other Wayland compositors without a
+// supported IPC), as opposed to a lookup that failed.
+var errWindowUnsupported = errors.New("focused window unknown on this display server")
+
+// activeWindow asks the compositor or X server which window has focus:
+// hyprctl on Hyprland, swaymsg/i3-msg on Sway and i3, xdotool on other X11
+// window managers. Other Wayland compositors don't expose this, so it
+// returns an error there.
+func activeWindow() (focusedWindow, error) {
+	switch {
+	case os.Getenv("HYPRLAND_INSTANCE_SIGNATURE") != "":
+		return hyprlandWindow()
+	case os.Getenv("SWAYSOCK") != "":
+		return treeWindow("swaymsg")
+	case os.Getenv("I3SOCK") != "":
+		return treeWindow("i3-msg")
+	case os.Getenv("DISPLAY") != "" && os.Getenv("WAYLAND_DISPLAY") == "":
+		return x11Window()
+	}
+	return focusedWindow{}, errWindowUnsupported
+}
+
+func x11Window() (focusedWindow, error) {
+	xdotool := func(args ...string) (string, error) {
+		out, err := exec.Command("xdotool", args...).Output()
+		if err != nil {
+			return "", fmt.Errorf("xdotool %s: %w", args[0], err)
+		}
+		return strings.TrimRight(string(out), "\n"), nil
+	}
+	id, err := xdotool("getactivewindow")
+	if err != nil {
+		return focusedWindow{}, err
+	}
+	// A window without WM_CLASS or a title is still the focused window.
+	class, _ := xdotool("getwindowclassname", id)
+	title, _ := xdotool("getwindowname", id)
+	return focusedWindow{ID: id, Class: class, Title: title}, nil
+}
+
+func hyprlandWindow() (focusedWindow, error) {
+	out, err := exec.Command("hyprctl", "activewindow", "-j").Output()
+	if err != nil {
+		return focusedWindow{}, fmt.Errorf("hyprctl: %w", err)
+	}
+	var w struct {
+		Address string `json:"address"`
+		Class   string `json:"class"`
+		Title   string `json:"title"`
+	}
+	if err := json.Unmarshal(out, &w); err != nil {
+		return focusedWindow{}, fmt.Errorf("parse hyprctl: %w", err)
+	}
+	return focusedWindow{ID: w.Address, Class: w.Class, Title: w.Title}, nil
+}
+
+// swayNode is the part of the sway/i3 layout tree (`swaymsg -t get_tree`,
+// same format from i3-msg) needed to find the focused window.
+type swayNode struct {
+	ID               int64      `json:"id"`
+	Name             string     `json:"name"`
+	AppID            string     `json:"app_id"`
+	Focused          bool       `json:"focused"`
+	Nodes            []swayNode `json:"nodes"`
+	FloatingNodes    []swayNode `json:"floating_nodes"`
+	WindowProperties struct {
+		Class string `json:"class"`
+	} `json:"window_properties"`
+}
+
+func treeWindow(tool string) (focusedWindow, error) {
+	out, err := exec.Command(tool, "-t", "get_tree").Output()
+	if err != nil {
+		return focusedWindow{}, fmt.Errorf("%s: %w", tool, err)
+	}
+	var root swayNode
+	if err := json.Unmarshal(out, &root); err != nil {
+		return focusedWindow{}, fmt.Errorf("parse %s: %w", tool, err)
+	}
+	n := root.focused()
+	if n == nil {
+		return focusedWindow{}, fmt.Errorf("%s: no focused window", tool)
+	}
+	class := n.AppID
+	if class == "" {
+		class = n.WindowProperties.Class // i3, XWayland
+	}
+	return focusedWindow{ID: strconv.FormatInt(n.ID, 10), Class: class, Title: n.Name}, nil
+}
+
+func (n *swayNode) focused() *swayNode {
+	if n.Focused {
+		return n
+	}
+	for _, list := range [][]swayNode{n.Nodes, n.FloatingNodes} {
+		for i := range list {
+			if f := list[i].focused(); f != nil {
+				return f
+			}
+		}
+	}
+	return nil
+}